@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// deb 文件是 ar 格式的归档，这里实现了读写 ar 文件的最小功能。
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+	arFileMagic  = "`\n"
+)
+
+type arHeader struct {
+	name string
+	size int64
+	// 原始的文件头，写入时除了 size 字段都保持不变
+	raw [arHeaderSize]byte
+}
+
+func (hdr *arHeader) setSize(size int64) error {
+	sizeStr := strconv.FormatInt(size, 10)
+	if len(sizeStr) > 10 {
+		return fmt.Errorf("ar: member %s is too large", hdr.name)
+	}
+	copy(hdr.raw[48:58], fmt.Sprintf("%-10s", sizeStr))
+	hdr.size = size
+	return nil
+}
+
+type arReader struct {
+	r      io.Reader
+	remain int64
+	pad    int64
+}
+
+func newArReader(r io.Reader) (*arReader, error) {
+	var magic [len(arMagic)]byte
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != arMagic {
+		return nil, errors.New("ar: invalid magic")
+	}
+	return &arReader{r: r}, nil
+}
+
+// next 跳到下一个成员，读完所有成员后返回 io.EOF。
+func (ar *arReader) next() (*arHeader, error) {
+	_, err := io.CopyN(ioutil.Discard, ar.r, ar.remain+ar.pad)
+	if err != nil {
+		return nil, err
+	}
+	ar.remain = 0
+	ar.pad = 0
+
+	var hdr arHeader
+	_, err = io.ReadFull(ar.r, hdr.raw[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("ar: truncated header")
+		}
+		return nil, err
+	}
+	if string(hdr.raw[58:60]) != arFileMagic {
+		return nil, errors.New("ar: invalid file header")
+	}
+
+	name := string(bytes.TrimRight(hdr.raw[0:16], " "))
+	// GNU ar 的文件名以 / 结尾
+	hdr.name = strings.TrimSuffix(name, "/")
+	hdr.size, err = strconv.ParseInt(string(bytes.TrimRight(hdr.raw[48:58], " ")), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ar: invalid size of member %s", hdr.name)
+	}
+
+	ar.remain = hdr.size
+	ar.pad = hdr.size % 2
+	return &hdr, nil
+}
+
+func (ar *arReader) Read(p []byte) (int, error) {
+	if ar.remain == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > ar.remain {
+		p = p[:ar.remain]
+	}
+	n, err := ar.r.Read(p)
+	ar.remain -= int64(n)
+	if err == io.EOF && ar.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+type arWriter struct {
+	w      io.Writer
+	remain int64
+	pad    int64
+}
+
+func newArWriter(w io.Writer) (*arWriter, error) {
+	_, err := io.WriteString(w, arMagic)
+	if err != nil {
+		return nil, err
+	}
+	return &arWriter{w: w}, nil
+}
+
+func (aw *arWriter) writeHeader(hdr *arHeader) error {
+	err := aw.flush()
+	if err != nil {
+		return err
+	}
+	_, err = aw.w.Write(hdr.raw[:])
+	if err != nil {
+		return err
+	}
+	aw.remain = hdr.size
+	aw.pad = hdr.size % 2
+	return nil
+}
+
+func (aw *arWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > aw.remain {
+		return 0, errors.New("ar: write too long")
+	}
+	n, err := aw.w.Write(p)
+	aw.remain -= int64(n)
+	return n, err
+}
+
+// flush 在成员的数据后补齐填充字节。
+func (aw *arWriter) flush() error {
+	if aw.remain != 0 {
+		return errors.New("ar: missed writing data")
+	}
+	if aw.pad != 0 {
+		_, err := aw.w.Write([]byte{'\n'})
+		if err != nil {
+			return err
+		}
+		aw.pad = 0
+	}
+	return nil
+}
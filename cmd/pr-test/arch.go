@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// 默认安装本机架构、dpkg 添加的外部架构和 all 的包，-arch 可以指定要安装的架构。
+// 外部架构的包名加上 :arch 后缀，比如 libdtkcore5:i386。
+
+const archAll = "all"
+
+func getForeignArchs() ([]string, error) {
+	out, err := exec.Command("dpkg", "--print-foreign-architectures").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(bytes.TrimSpace(out))), nil
+}
+
+// getInstallArchs 返回可以安装的架构，不包括 all。
+func getInstallArchs() ([]string, error) {
+	if flagArch != "" {
+		return splitPatterns(flagArch), nil
+	}
+	hostArch, err := getDpkgArch()
+	if err != nil {
+		return nil, err
+	}
+	foreignArchs, err := getForeignArchs()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{hostArch}, foreignArchs...), nil
+}
+
+// getPkgKey 返回用于 apt、dpkg 和安装记录的包名，外部架构的包加上 :arch 后缀。
+func getPkgKey(pkgName, arch string) (string, error) {
+	if arch == archAll || arch == "" {
+		return pkgName, nil
+	}
+	hostArch, err := getDpkgArch()
+	if err != nil {
+		return "", err
+	}
+	if arch == hostArch {
+		return pkgName, nil
+	}
+	return pkgName + ":" + arch, nil
+}
+
+// trimPkgArch 去掉包名的 :arch 后缀。
+func trimPkgArch(pkg string) string {
+	return strings.SplitN(pkg, ":", 2)[0]
+}
+
+func showSkippedArtifacts(skipped []string, archs []string) {
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Printf("skip artifacts not of architecture %s:\n", strings.Join(append(archs, archAll), ", "))
+	for _, name := range skipped {
+		fmt.Println("  ", name)
+	}
+}
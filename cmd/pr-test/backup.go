@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sh "github.com/codeskyblue/go-sh"
+)
+
+// 安装测试包之前，把已安装的包保存为 deb 文件，恢复时不需要网络。
+
+var backupDir = filepath.Join(markDir, "backup")
+
+const aptArchivesDir = "/var/cache/apt/archives"
+
+func getDebFilename(pkg, version, arch string) string {
+	// apt 下载的文件名中 : 被转义为 %3a
+	version = strings.Replace(version, ":", "%3a", -1)
+	return fmt.Sprintf("%s_%s_%s.deb", pkg, version, arch)
+}
+
+func getInstalledArch(pkg string) (string, error) {
+	info, err := getPkgDB().getInstalled(pkg)
+	if err != nil {
+		return "", err
+	}
+	if info == nil {
+		return "", fmt.Errorf("package %s is not installed", pkg)
+	}
+	return info.arch, nil
+}
+
+// backupInstalledDeb 保存已安装的包，依次尝试 apt 的缓存，apt-get download 和 dpkg-repack，
+// 返回保存的文件名。
+func backupInstalledDeb(pkg, version string) (string, error) {
+	arch, err := getInstalledArch(pkg)
+	if err != nil {
+		return "", err
+	}
+	debFilename := getDebFilename(trimPkgArch(pkg), version, arch)
+	dest := filepath.Join(backupDir, debFilename)
+	if _, err := os.Stat(dest); err == nil {
+		return dest, nil
+	}
+
+	src := filepath.Join(aptArchivesDir, debFilename)
+	if _, err := os.Stat(src); err == nil {
+		debug("backup from apt archives:", src)
+		return dest, installBackupFile(src, dest)
+	}
+
+	tempDir, err := ioutil.TempDir("", "pr-test-backup")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err := sh.Command("sudo", "rm", "-rf", tempDir).Run()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+
+	session := sh.NewSession().SetDir(tempDir)
+	err = session.Command("apt-get", "download", pkg+"="+version).Run()
+	if err != nil {
+		debug("apt-get download failed:", err)
+		if _, lookErr := sh.Command("which", "dpkg-repack").Output(); lookErr != nil {
+			return "", errors.New("apt-get download failed and dpkg-repack is not installed")
+		}
+		err = session.Command("sudo", "dpkg-repack", pkg).Run()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	matches, err := filepath.Glob(filepath.Join(tempDir, trimPkgArch(pkg)+"_*.deb"))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("not found deb file of %s", pkg)
+	}
+	return dest, installBackupFile(matches[0], dest)
+}
+
+func installBackupFile(src, dest string) error {
+	return sh.Command("sudo", "install", "-D", "-m", "0644", src, dest).Run()
+}
+
+func removeBackupFile(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	_, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return sh.Command("sudo", "rm", filename).Run()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 下载的 deb 文件缓存在 ~/.cache/deepin-pr-test 中，以 job url 和文件名为索引，
+// 重复安装同一个 job 的包时不需要再下载。
+
+const defaultCacheMaxSizeMB = 2048
+
+const cacheIndexFile = "index.json"
+
+type cacheIndex struct {
+	Jobs    map[string]*cacheJob   `json:"jobs"`
+	Entries map[string]*cacheEntry `json:"entries"`
+}
+
+// cacheJob 记录 job 的构建产物，job 构建完成后就不会再变了。
+type cacheJob struct {
+	Artifacts []cacheArtifact `json:"artifacts"`
+	LastUsed  time.Time       `json:"last_used"`
+}
+
+type cacheArtifact struct {
+	Url    string `json:"url"`
+	Md5    string `json:"md5,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type cacheEntry struct {
+	JobUrl string `json:"job_url"`
+	Name   string `json:"name"`
+	// 相对于缓存目录
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type debCache struct {
+	dir   string
+	index cacheIndex
+}
+
+func getCacheDir() (string, error) {
+	cacheDir := os.Getenv("XDG_CACHE_HOME")
+	if cacheDir == "" {
+		home, err := getHome()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(cacheDir, "deepin-pr-test"), nil
+}
+
+func openDebCache() (*debCache, error) {
+	dir, err := getCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &debCache{dir: dir}
+	content, err := ioutil.ReadFile(filepath.Join(dir, cacheIndexFile))
+	if err == nil {
+		err = json.Unmarshal(content, &c.index)
+		if err != nil {
+			log.Println("WARN: invalid cache index:", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if c.index.Jobs == nil {
+		c.index.Jobs = make(map[string]*cacheJob)
+	}
+	if c.index.Entries == nil {
+		c.index.Entries = make(map[string]*cacheEntry)
+	}
+	return c, nil
+}
+
+func (c *debCache) save() error {
+	content, err := json.MarshalIndent(&c.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := filepath.Join(c.dir, cacheIndexFile+".tmp")
+	err = ioutil.WriteFile(tempFile, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile, filepath.Join(c.dir, cacheIndexFile))
+}
+
+func getCacheEntryKey(jobUrl, name string) string {
+	return jobUrl + " " + name
+}
+
+func (c *debCache) getJobDir(jobUrl string) string {
+	sum := sha1.Sum([]byte(jobUrl))
+	return filepath.Join(c.dir, "debs", hex.EncodeToString(sum[:8]))
+}
+
+func (c *debCache) getJobArtifacts(jobUrl string) []*debArtifact {
+	job := c.index.Jobs[jobUrl]
+	if job == nil {
+		return nil
+	}
+	var result []*debArtifact
+	for _, a := range job.Artifacts {
+		u, err := url.Parse(a.Url)
+		if err != nil {
+			return nil
+		}
+		result = append(result, &debArtifact{
+			url:    u,
+			md5:    a.Md5,
+			sha256: a.Sha256,
+		})
+	}
+	job.LastUsed = time.Now()
+	return result
+}
+
+func (c *debCache) setJobArtifacts(jobUrl string, artifacts []*debArtifact) {
+	job := &cacheJob{LastUsed: time.Now()}
+	for _, a := range artifacts {
+		job.Artifacts = append(job.Artifacts, cacheArtifact{
+			Url:    a.url.String(),
+			Md5:    a.md5,
+			Sha256: a.sha256,
+		})
+	}
+	c.index.Jobs[jobUrl] = job
+}
+
+// lookup 返回缓存中有效的文件，没有时返回空字符串。
+func (c *debCache) lookup(jobUrl string, artifact *debArtifact) string {
+	name, err := getUrlBasename(artifact.url)
+	if err != nil {
+		return ""
+	}
+	key := getCacheEntryKey(jobUrl, name)
+	entry := c.index.Entries[key]
+	if entry == nil {
+		return ""
+	}
+	filename := filepath.Join(c.dir, entry.File)
+	fileInfo, err := os.Stat(filename)
+	if err == nil && fileInfo.Size() != entry.Size {
+		err = fmt.Errorf("size of %s changed", filename)
+	}
+	if err == nil {
+		err = artifact.verify(filename)
+	}
+	if err != nil {
+		debug("invalid cache:", err)
+		c.remove(key)
+		return ""
+	}
+	entry.LastUsed = time.Now()
+	return filename
+}
+
+func (c *debCache) add(jobUrl string, artifact *debArtifact, filename string) error {
+	name, err := getUrlBasename(artifact.url)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	relFile, err := filepath.Rel(c.dir, filename)
+	if err != nil {
+		return err
+	}
+	c.index.Entries[getCacheEntryKey(jobUrl, name)] = &cacheEntry{
+		JobUrl:   jobUrl,
+		Name:     name,
+		File:     relFile,
+		Size:     fileInfo.Size(),
+		LastUsed: time.Now(),
+	}
+	return nil
+}
+
+func (c *debCache) remove(key string) {
+	entry := c.index.Entries[key]
+	if entry == nil {
+		return
+	}
+	err := os.Remove(filepath.Join(c.dir, entry.File))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("WARN:", err)
+	}
+	delete(c.index.Entries, key)
+}
+
+// evict 按最近最少使用的顺序删除文件，直到总大小不超过 maxSize，
+// 但不会删除 since 之后用过的文件。
+func (c *debCache) evict(maxSize int64, since time.Time) {
+	var keys []string
+	var total int64
+	for key, entry := range c.index.Entries {
+		keys = append(keys, key)
+		total += entry.Size
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.index.Entries[keys[i]].LastUsed.Before(c.index.Entries[keys[j]].LastUsed)
+	})
+
+	for _, key := range keys {
+		if total <= maxSize {
+			break
+		}
+		entry := c.index.Entries[key]
+		if !entry.LastUsed.Before(since) {
+			break
+		}
+		debug("evict cache:", entry.File)
+		total -= entry.Size
+		c.remove(key)
+	}
+
+	// 没有文件的 job 也删掉
+	usedJobs := make(map[string]bool)
+	for _, entry := range c.index.Entries {
+		usedJobs[entry.JobUrl] = true
+	}
+	for jobUrl, job := range c.index.Jobs {
+		if !usedJobs[jobUrl] && job.LastUsed.Before(since) {
+			delete(c.index.Jobs, jobUrl)
+		}
+	}
+}
+
+// fetchDebs 返回 artifacts 对应的本地文件，只下载缓存中没有的。
+func (c *debCache) fetchDebs(jobUrl string, artifacts []*debArtifact) ([]string, error) {
+	startTime := time.Now()
+	filenames := make([]string, len(artifacts))
+	var missingIdxList []int
+	var missingArtifacts []*debArtifact
+	for idx, artifact := range artifacts {
+		filename := c.lookup(jobUrl, artifact)
+		if filename != "" {
+			debug("use cache:", filename)
+			filenames[idx] = filename
+			continue
+		}
+		missingIdxList = append(missingIdxList, idx)
+		missingArtifacts = append(missingArtifacts, artifact)
+	}
+
+	if len(missingArtifacts) > 0 {
+		downloadedFiles, err := downloadDebs(missingArtifacts, c.getJobDir(jobUrl))
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range missingIdxList {
+			filenames[idx] = downloadedFiles[i]
+			err = c.add(jobUrl, artifacts[idx], downloadedFiles[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c.evict(int64(getConfig().Cache.MaxSizeMB)*1024*1024, startTime)
+	err := c.save()
+	if err != nil {
+		log.Println("WARN: failed to save cache index:", err)
+	}
+	return filenames, nil
+}
+
+func cleanCache() error {
+	dir, err := getCacheDir()
+	if err != nil {
+		return err
+	}
+	fmt.Println("remove", dir)
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	sh "github.com/codeskyblue/go-sh"
+	"pault.ag/go/debian/version"
+)
+
+// -check 检查测试安装的包是否过时了：改动已经合并或者放弃，有了新的 revision，
+// 或者软件源中有了更新的版本，然后询问是否恢复或者升级。
+
+const (
+	// 软件源中有更新的版本，升级到软件源的版本
+	checkActionUpgrade = "upgrade"
+	// 改动已经合并或者放弃，恢复到原来的版本
+	checkActionRestore = "restore"
+	// 改动有了新的 revision，安装最新的
+	checkActionUpdate = "update"
+)
+
+type checkResult struct {
+	record    *installRecord
+	reasons   []string
+	action    string
+	candidate string
+}
+
+func checkRecord(record *installRecord, statusCache changeStatusCache, policy pkgPolicy) *checkResult {
+	result := &checkResult{record: record}
+
+	status, err := queryChangeStatus(record, statusCache)
+	if err != nil {
+		log.Printf("WARN: failed to query state of %s: %v\n", record.ChangeUrl, err)
+	} else {
+		if status.state != changeStateOpen {
+			result.reasons = append(result.reasons, "change is "+status.state)
+			result.action = checkActionRestore
+		} else if record.Revision != "" && status.revision != "" && status.revision != record.Revision {
+			result.reasons = append(result.reasons, fmt.Sprintf("revision %s is superseded by %s",
+				shortRevision(record.Revision), shortRevision(status.revision)))
+			result.action = checkActionUpdate
+		}
+	}
+
+	if isNewerVersion(policy.candidateVersion, policy.installedVersion) {
+		result.reasons = append(result.reasons, "archive has newer version "+policy.candidateVersion)
+		result.action = checkActionUpgrade
+		result.candidate = policy.candidateVersion
+	}
+	return result
+}
+
+func isNewerVersion(ver, base string) bool {
+	if ver == "" || base == "" {
+		return false
+	}
+	v1, err := version.Parse(ver)
+	if err != nil {
+		return false
+	}
+	v2, err := version.Parse(base)
+	if err != nil {
+		return false
+	}
+	return version.Compare(v1, v2) > 0
+}
+
+// shortRevision 缩短 github 的 commit id。
+func shortRevision(revision string) string {
+	if len(revision) > 8 {
+		return revision[:8]
+	}
+	return revision
+}
+
+func checkInstalled() error {
+	err := recoverInstallJournal()
+	if err != nil {
+		return err
+	}
+	records, _, err := loadInstallRecords()
+	if err != nil {
+		return err
+	}
+
+	var pkgs []string
+	for _, record := range records {
+		pkgs = append(pkgs, record.Package)
+	}
+	policies, err := getPkgDB().getPolicies(pkgs)
+	if err != nil {
+		return err
+	}
+
+	statusCache := make(changeStatusCache)
+	actionResults := make(map[string][]*checkResult)
+	for _, record := range records {
+		result := checkRecord(record, statusCache, policies[record.Package])
+		if len(result.reasons) == 0 {
+			continue
+		}
+		fmt.Printf("%s (%s): %s\n", record.Package, record.ChangeUrl, strings.Join(result.reasons, ", "))
+		actionResults[result.action] = append(actionResults[result.action], result)
+	}
+	if len(actionResults) == 0 {
+		fmt.Println("all test installed packages are up to date")
+		return nil
+	}
+	fmt.Println()
+
+	if results := actionResults[checkActionUpgrade]; len(results) > 0 {
+		err = upgradeCheckResults(results)
+		if err != nil {
+			return err
+		}
+	}
+	if results := actionResults[checkActionRestore]; len(results) > 0 {
+		err = restoreCheckResults(results)
+		if err != nil {
+			return err
+		}
+	}
+	if results := actionResults[checkActionUpdate]; len(results) > 0 {
+		err = updateCheckResults(results)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func confirmCheckAction(prompt string) (bool, error) {
+	if flagYes {
+		fmt.Println(prompt, "yes")
+		return true, nil
+	}
+	return askYesNo(prompt, true)
+}
+
+func getCheckResultPkgs(results []*checkResult) []string {
+	var pkgs []string
+	for _, result := range results {
+		pkgs = append(pkgs, result.record.Package)
+	}
+	return pkgs
+}
+
+func upgradeCheckResults(results []*checkResult) error {
+	pkgs := getCheckResultPkgs(results)
+	yes, err := confirmCheckAction(fmt.Sprintf("upgrade %s to the archive version?", strings.Join(pkgs, " ")))
+	if err != nil || !yes {
+		return err
+	}
+	cmdArgs := []string{"apt-get", "install", "-y"}
+	for _, result := range results {
+		cmdArgs = append(cmdArgs, result.record.Package+"="+result.candidate)
+	}
+	err = sh.Command("sudo", cmdArgs).Run()
+	if err != nil {
+		return err
+	}
+	return clearRestoredMarks(pkgs)
+}
+
+func restoreCheckResults(results []*checkResult) error {
+	pkgs := getCheckResultPkgs(results)
+	yes, err := confirmCheckAction(fmt.Sprintf("restore %s?", strings.Join(pkgs, " ")))
+	if err != nil || !yes {
+		return err
+	}
+	var records []*installRecord
+	for _, result := range results {
+		records = append(records, result.record)
+	}
+	err = restorePackages(records)
+	if err != nil {
+		return err
+	}
+	return clearRestoredMarks(pkgs)
+}
+
+// updateCheckResults 重新安装改动最新的 revision 的包。
+func updateCheckResults(results []*checkResult) error {
+	var changeUrls []string
+	for _, result := range results {
+		if !strSliceContains(changeUrls, result.record.ChangeUrl) {
+			changeUrls = append(changeUrls, result.record.ChangeUrl)
+		}
+	}
+	for _, changeUrl := range changeUrls {
+		yes, err := confirmCheckAction(fmt.Sprintf("install the latest revision of %s?", changeUrl))
+		if err != nil {
+			return err
+		}
+		if !yes {
+			continue
+		}
+		changes, err := resolveChanges([]string{changeUrl})
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			err = installChange(c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
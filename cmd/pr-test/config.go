@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 配置文件默认为 ~/.config/deepin-pr-test/config.yaml，比如：
+//
+//	gerrit:
+//	  url: https://gerrit.uniontech.com
+//	  auth: basic
+//	  user: zhangsan
+//	  password: xxxxxx
+//	  project: dde-daemon
+//	  branch: master
+//	download:
+//	  jobs: 4
+//	cache:
+//	  max_size_mb: 2048
+//	packages:
+//	  exclude: ["*-dev", "*-dbg", "*-dbgsym", "libdtkwidget-bin"]
+//	version:
+//	  policy: installed
+type config struct {
+	Gerrit   gerritConfig   `yaml:"gerrit"`
+	Download downloadConfig `yaml:"download"`
+	Cache    cacheConfig    `yaml:"cache"`
+	Packages packagesConfig `yaml:"packages"`
+	Version  versionConfig  `yaml:"version"`
+}
+
+type gerritConfig struct {
+	Url string `yaml:"url"`
+	// Auth 可以是 basic，digest 或 cookie
+	Auth     string `yaml:"auth"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Cookie 格式为 name=value
+	Cookie  string `yaml:"cookie"`
+	Project string `yaml:"project"`
+	Branch  string `yaml:"branch"`
+}
+
+type downloadConfig struct {
+	// 同时下载的文件数
+	Jobs int `yaml:"jobs"`
+}
+
+type cacheConfig struct {
+	// 缓存的 deb 文件的总大小上限
+	MaxSizeMB int `yaml:"max_size_mb"`
+}
+
+type packagesConfig struct {
+	// 默认不安装的包名的通配符，没有配置时使用 defaultExcludePatterns
+	Exclude []string `yaml:"exclude"`
+}
+
+type versionConfig struct {
+	// 测试包的版本策略，可以是 ci，installed 或 above
+	Policy string `yaml:"policy"`
+}
+
+const defaultGerritUrl = "https://gerrit.uniontech.com"
+
+func getConfigFile() (string, error) {
+	if flagConfig != "" {
+		return flagConfig, nil
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := getHome()
+		if err != nil {
+			return "", err
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "deepin-pr-test/config.yaml"), nil
+}
+
+func loadConfig(filename string) (*config, error) {
+	var cfg config
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) && flagConfig == "" {
+			return &cfg, nil
+		}
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// applyFlags 命令行参数优先于配置文件。
+func (cfg *config) applyFlags() {
+	overrideStr(&cfg.Gerrit.Url, flagGerritUrl)
+	overrideStr(&cfg.Gerrit.Auth, flagGerritAuth)
+	overrideStr(&cfg.Gerrit.User, flagGerritUser)
+	overrideStr(&cfg.Gerrit.Password, flagGerritPassword)
+	overrideStr(&cfg.Gerrit.Cookie, flagGerritCookie)
+	overrideStr(&cfg.Gerrit.Project, flagGerritProject)
+	overrideStr(&cfg.Gerrit.Branch, flagGerritBranch)
+
+	overrideStr(&cfg.Version.Policy, flagVersionPolicy)
+	if flagDownloadJobs > 0 {
+		cfg.Download.Jobs = flagDownloadJobs
+	}
+
+	if cfg.Gerrit.Url == "" {
+		cfg.Gerrit.Url = defaultGerritUrl
+	}
+	if cfg.Download.Jobs <= 0 {
+		cfg.Download.Jobs = defaultDownloadJobs
+	}
+	if cfg.Cache.MaxSizeMB <= 0 {
+		cfg.Cache.MaxSizeMB = defaultCacheMaxSizeMB
+	}
+	if cfg.Version.Policy == "" {
+		cfg.Version.Policy = defaultVersionPolicy
+	}
+	if cfg.Packages.Exclude == nil {
+		cfg.Packages.Exclude = defaultExcludePatterns
+	}
+}
+
+func overrideStr(dest *string, value string) {
+	if value != "" {
+		*dest = value
+	}
+}
+
+var globalConfig *config
+
+func getConfig() *config {
+	if globalConfig != nil {
+		return globalConfig
+	}
+
+	cfg := &config{}
+	filename, err := getConfigFile()
+	if err == nil {
+		debug("config file:", filename)
+		cfg, err = loadConfig(filename)
+	}
+	if err != nil {
+		log.Println("WARN: failed to load config:", err)
+		cfg = &config{}
+	}
+	cfg.applyFlags()
+	globalConfig = cfg
+	return cfg
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// 修改 deb 文件中的 control 文件，只重写 control.tar.* 成员，其他成员原样复制。
+
+const (
+	extGz   = ".gz"
+	extXz   = ".xz"
+	extZst  = ".zst"
+	extNone = ".tar"
+)
+
+func modifyDeb(filename string, detail *debDetail) (modifiedFilename string, err error) {
+	modifiedFilename = filepath.Join(tempDebModifiedDir, filepath.Base(filename))
+	debug("modifiedFilename:", modifiedFilename)
+
+	err = os.MkdirAll(tempDebModifiedDir, 0755)
+	if err != nil {
+		return
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := in.Close()
+		if err != nil {
+			log.Println("WARN: failed to close file:", err)
+		}
+	}()
+
+	out, err := os.Create(modifiedFilename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	bw := bufio.NewWriter(out)
+	err = rewriteDeb(bufio.NewReader(in), bw, func(control []byte) ([]byte, error) {
+		return modifyControl(control, detail)
+	})
+	if err != nil {
+		return
+	}
+	err = bw.Flush()
+	return
+}
+
+// rewriteDeb 从 r 读取 deb 文件，用 fn 修改其中的 control 文件后写入 w。
+func rewriteDeb(r io.Reader, w io.Writer, fn func(control []byte) ([]byte, error)) error {
+	ar, err := newArReader(r)
+	if err != nil {
+		return err
+	}
+	aw, err := newArWriter(w)
+	if err != nil {
+		return err
+	}
+
+	var foundControlTar bool
+	for {
+		hdr, err := ar.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(hdr.name, "control.tar") {
+			foundControlTar = true
+			data, err := rewriteControlTar(ar, filepath.Ext(hdr.name), fn)
+			if err != nil {
+				return err
+			}
+			err = hdr.setSize(int64(len(data)))
+			if err != nil {
+				return err
+			}
+			err = aw.writeHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = aw.Write(data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = aw.writeHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(aw, ar)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !foundControlTar {
+		return errors.New("not found control tar file in deb file")
+	}
+	return aw.flush()
+}
+
+func newDecompressReader(r io.Reader, ext string) (io.ReadCloser, error) {
+	switch ext {
+	case extGz:
+		return gzip.NewReader(r)
+	case extXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case extZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case extNone:
+		return ioutil.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown control.tar ext %q", ext)
+	}
+}
+
+func newCompressWriter(w io.Writer, ext string) (io.WriteCloser, error) {
+	switch ext {
+	case extGz:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case extXz:
+		return xz.NewWriter(w)
+	case extZst:
+		return zstd.NewWriter(w)
+	case extNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown control.tar ext %q", ext)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// rewriteControlTar 返回修改后的 control.tar 压缩数据，压缩方式与原来的相同。
+func rewriteControlTar(r io.Reader, ext string, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	dr, err := newDecompressReader(r, ext)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := dr.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+
+	var buf bytes.Buffer
+	cw, err := newCompressWriter(&buf, ext)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(dr)
+	tw := tar.NewWriter(cw)
+	var foundControl bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if path.Clean(hdr.Name) != "control" {
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(tw, tr)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		foundControl = true
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		data, err = fn(data)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Size = int64(len(data))
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !foundControl {
+		return nil, errors.New("not found control file in control tar")
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = cw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var flagUpdateGolden = flag.Bool("update", false, "update golden files")
+
+const testDebFile = "testdata/hello-prtest_1.0-1_all.deb"
+
+type testArMember struct {
+	name string
+	data []byte
+}
+
+// parseTestAr 独立于 arReader 解析 ar 文件，检查每个成员头中的大小和奇数大小成员后的填充字节。
+func parseTestAr(t *testing.T, data []byte) []testArMember {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte(arMagic)) {
+		t.Fatal("invalid ar magic")
+	}
+	var members []testArMember
+	offset := len(arMagic)
+	for offset < len(data) {
+		if offset+arHeaderSize > len(data) {
+			t.Fatalf("truncated header at %d", offset)
+		}
+		hdr := data[offset : offset+arHeaderSize]
+		if string(hdr[58:60]) != arFileMagic {
+			t.Fatalf("invalid header magic at %d", offset)
+		}
+		name := strings.TrimSuffix(strings.TrimRight(string(hdr[0:16]), " "), "/")
+		size, err := strconv.Atoi(strings.TrimRight(string(hdr[48:58]), " "))
+		if err != nil {
+			t.Fatalf("invalid size field %q of %s", hdr[48:58], name)
+		}
+		offset += arHeaderSize
+		if offset+size > len(data) {
+			t.Fatalf("member %s is truncated", name)
+		}
+		members = append(members, testArMember{name: name, data: data[offset : offset+size]})
+		offset += size
+		if size%2 == 1 {
+			if offset >= len(data) || data[offset] != '\n' {
+				t.Fatalf("missing padding after odd size member %s", name)
+			}
+			offset++
+		}
+	}
+	return members
+}
+
+func addTestField(control []byte) ([]byte, error) {
+	return append(control, "X-Pr-Test: yes\n"...), nil
+}
+
+func TestRewriteDeb(t *testing.T) {
+	in, err := ioutil.ReadFile(testDebFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = rewriteDeb(bytes.NewReader(in), &out, addTestField)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inMembers := parseTestAr(t, in)
+	outMembers := parseTestAr(t, out.Bytes())
+	if len(inMembers) != len(outMembers) {
+		t.Fatalf("got %d members, want %d", len(outMembers), len(inMembers))
+	}
+	var oddSize bool
+	for idx, inMember := range inMembers {
+		outMember := outMembers[idx]
+		if inMember.name != outMember.name {
+			t.Errorf("member %d: got name %s, want %s", idx, outMember.name, inMember.name)
+		}
+		if len(inMember.data)%2 == 1 {
+			oddSize = true
+		}
+		changed := !bytes.Equal(inMember.data, outMember.data)
+		isControl := strings.HasPrefix(inMember.name, "control.tar")
+		if isControl != changed {
+			t.Errorf("member %s: changed is %v", inMember.name, changed)
+		}
+	}
+	if !oddSize {
+		t.Error("test deb should have odd size members")
+	}
+
+	origControl, err := readDebControl(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newControl, err := readDebControl(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newControl.Values["X-Pr-Test"] != "yes" {
+		t.Error("control is not rewritten")
+	}
+	if newControl.Package != origControl.Package || newControl.Values["Version"] != origControl.Values["Version"] {
+		t.Error("other fields of control changed")
+	}
+}
+
+// dpkg-deb -I 的输出中包含压缩后的大小，与 Go 的版本有关，不做比较。
+var regDpkgDebSize = regexp.MustCompile(`(?m)^ size \d+ bytes: control archive=\d+ bytes\.$`)
+
+var regDebModifyTime = regexp.MustCompile(`(?m)^(\s*DEB_MODIFY_TIME=).*$`)
+
+func newTestDebDetail() *debDetail {
+	return &debDetail{
+		url: "https://ci.deepin.io/job/hello/3/artifact/hello-prtest_1.0-1_all.deb",
+		jobDetail: &jobDetail{
+			url: "https://ci.deepin.io/job/hello/3/",
+			detail: &patchDetail{
+				backend:  "github",
+				url:      "https://github.com/linuxdeepin/hello/pull/36",
+				repo:     "hello",
+				num:      36,
+				user:     "electricface",
+				title:    "fix: say hello",
+				state:    "open",
+				revision: "1a2b3c4d",
+			},
+			versions: map[string]*versionChange{
+				"hello-prtest": {ciVersion: "1.0-1", newVersion: "0.9-1", installedVersion: "0.9-1"},
+			},
+		},
+	}
+}
+
+// TestRewriteDebDpkgInfo 用 modifyControl 修改每种压缩方式的 deb，
+// 和 dpkg-deb -I 的输出的 golden 文件比较，用 -update 参数更新 golden 文件。
+func TestRewriteDebDpkgInfo(t *testing.T) {
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		t.Skip("dpkg-deb is not installed")
+	}
+	// DEB_MODIFY_TIME 的长度和时区有关
+	oldLocal := time.Local
+	time.Local = time.UTC
+	defer func() {
+		time.Local = oldLocal
+	}()
+
+	tests := []struct {
+		name       string
+		file       string
+		memberName string
+	}{
+		{"gz", testDebFile, "control.tar.gz"},
+		{"xz", "testdata/hello-prtest_1.0-1_all.xz.deb", "control.tar.xz"},
+		{"zst", "testdata/hello-prtest_1.0-1_all.zst.deb", "control.tar.zst"},
+		{"tar", "testdata/hello-prtest_1.0-1_all.tar.deb", "control.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 旧版本的 dpkg-deb 不支持 zst
+			err := exec.Command("dpkg-deb", "-I", tt.file).Run()
+			if err != nil {
+				t.Skipf("dpkg-deb can not read %s: %v", tt.file, err)
+			}
+			in, err := ioutil.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			detail := newTestDebDetail()
+			var out bytes.Buffer
+			err = rewriteDeb(bytes.NewReader(in), &out, func(data []byte) ([]byte, error) {
+				return modifyControl(data, detail)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			members := parseTestAr(t, out.Bytes())
+			if len(members) != 3 || members[1].name != tt.memberName {
+				t.Fatalf("invalid members %v", members)
+			}
+			if detail.pkgName != "hello-prtest" || detail.ciVersion != "1.0-1" || detail.newVersion != "0.9-1" {
+				t.Errorf("detail = %+v", detail)
+			}
+
+			filename := filepath.Join(t.TempDir(), "out.deb")
+			err = ioutil.WriteFile(filename, out.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := exec.Command("dpkg-deb", "-I", filename).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			info = regDpkgDebSize.ReplaceAll(info, []byte(" size SIZE bytes: control archive=SIZE bytes."))
+			info = regDebModifyTime.ReplaceAll(info, []byte("${1}TIME"))
+
+			golden := "testdata/hello-prtest." + tt.name + ".info.golden"
+			if *flagUpdateGolden {
+				err = ioutil.WriteFile(golden, info, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(info, want) {
+				t.Errorf("dpkg-deb -I output mismatch, got:\n%s\nwant:\n%s", info, want)
+			}
+		})
+	}
+}
+
+func TestArWriterPadding(t *testing.T) {
+	var buf bytes.Buffer
+	aw, err := newArWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{"a", "bb", "ccc", ""}
+	for idx, content := range contents {
+		var hdr arHeader
+		copy(hdr.raw[:], newTestArHeader("f"+strconv.Itoa(idx), 0))
+		err = hdr.setSize(int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = aw.writeHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = aw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = aw.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members := parseTestAr(t, buf.Bytes())
+	if len(members) != len(contents) {
+		t.Fatalf("got %d members", len(members))
+	}
+	for idx, member := range members {
+		if string(member.data) != contents[idx] {
+			t.Errorf("member %d: got %q, want %q", idx, member.data, contents[idx])
+		}
+	}
+}
+
+func newTestArHeader(name string, size int) string {
+	return padRight(name, 16) + padRight("1600000000", 12) + padRight("0", 6) + padRight("0", 6) +
+		padRight("100644", 8) + padRight(strconv.Itoa(size), 10) + arFileMagic
+}
+
+func padRight(s string, n int) string {
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+// buildTestDeb 生成一个 deb 文件，control 成员用 ext 对应的方式压缩。
+func buildTestDeb(t *testing.T, ext string, control string) []byte {
+	t.Helper()
+	var tarBuf bytes.Buffer
+	cw, err := newCompressWriter(&tarBuf, ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(cw)
+	files := []struct {
+		name, content string
+	}{
+		{"./control", control},
+		{"./md5sums", "d41d8cd98f00b204e9800998ecf8427e  usr/share/doc/foo/README\n"},
+	}
+	for _, f := range files {
+		err = tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(f.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controlName := "control.tar"
+	if ext != extNone {
+		controlName += ext
+	}
+	members := []testArMember{
+		{"debian-binary", []byte("2.0\n")},
+		{controlName, tarBuf.Bytes()},
+		{"data.tar.xz", []byte("not a real data archive")},
+	}
+	var buf bytes.Buffer
+	buf.WriteString(arMagic)
+	for _, m := range members {
+		buf.WriteString(newTestArHeader(m.name, len(m.data)))
+		buf.Write(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// detectCompression 根据文件头判断压缩方式。
+func detectCompression(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return extGz
+	case bytes.HasPrefix(data, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return extXz
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return extZst
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return extNone
+	}
+	return "unknown"
+}
+
+func TestRewriteDebCompression(t *testing.T) {
+	const control = "Package: foo\nVersion: 1.0-1\nArchitecture: amd64\nDescription: foo\n"
+	const newControl = "Package: foo\nVersion: 0.9-1\nArchitecture: amd64\nDescription: foo\n"
+	tests := []struct {
+		ext        string
+		memberName string
+	}{
+		{extGz, "control.tar.gz"},
+		{extXz, "control.tar.xz"},
+		{extZst, "control.tar.zst"},
+		{extNone, "control.tar"},
+	}
+	for _, test := range tests {
+		in := buildTestDeb(t, test.ext, control)
+		var gotControl string
+		var out bytes.Buffer
+		err := rewriteDeb(bytes.NewReader(in), &out, func(data []byte) ([]byte, error) {
+			gotControl = string(data)
+			return []byte(newControl), nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", test.memberName, err)
+			continue
+		}
+		if gotControl != control {
+			t.Errorf("%s: got control %q", test.memberName, gotControl)
+		}
+
+		members := parseTestAr(t, out.Bytes())
+		if len(members) != 3 || members[1].name != test.memberName {
+			t.Errorf("%s: invalid members %v", test.memberName, members)
+			continue
+		}
+		if c := detectCompression(members[1].data); c != test.ext {
+			t.Errorf("%s: got compression %s", test.memberName, c)
+		}
+
+		data, err := readControlTar(bytes.NewReader(members[1].data), filepath.Ext(test.memberName))
+		if err != nil {
+			t.Errorf("%s: %v", test.memberName, err)
+			continue
+		}
+		if string(data) != newControl {
+			t.Errorf("%s: got rewritten control %q", test.memberName, data)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// 安装前先读取 job 所有 deb 包的 control 文件，找出包之间的依赖关系，
+// 用户选择的包依赖的同一个 job 中的其他包（版本用 = 限定的）会被自动选上，否则 apt 会安装失败。
+
+// jobPackage 是 job 构建的一个包。
+type jobPackage struct {
+	key      string
+	name     string
+	arch     string
+	artifact *debArtifact
+	// 读取失败时为 nil
+	control *control.BinaryParagraph
+}
+
+// readDebControl 读取 deb 文件中的 control 文件，读到 control.tar 就返回，不会读取后面的 data.tar。
+func readDebControl(r io.Reader) (*control.BinaryParagraph, error) {
+	ar, err := newArReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := ar.next()
+		if err == io.EOF {
+			return nil, errors.New("not found control tar file in deb file")
+		} else if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(hdr.name, "control.tar") {
+			continue
+		}
+
+		data, err := readControlTar(ar, filepath.Ext(hdr.name))
+		if err != nil {
+			return nil, err
+		}
+		var binParagraph control.BinaryParagraph
+		err = control.Unmarshal(&binParagraph, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return &binParagraph, nil
+	}
+}
+
+func readControlTar(r io.Reader, ext string) ([]byte, error) {
+	dr, err := newDecompressReader(r, ext)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := dr.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("not found control file in control tar")
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == "control" {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// getArtifactControl 优先读取缓存的文件，没有缓存时通过 http 只读取 deb 文件的开头部分。
+func getArtifactControl(cache *debCache, jobUrl string, artifact *debArtifact) (*control.BinaryParagraph, error) {
+	if filename := cache.lookup(jobUrl, artifact); filename != "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			err := f.Close()
+			if err != nil {
+				log.Println("WARN:", err)
+			}
+		}()
+		return readDebControl(f)
+	}
+
+	u := artifact.url.String()
+	debug("read control from", u)
+	resp, err := httpGet(u)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status code %d", u, resp.StatusCode)
+	}
+	return readDebControl(resp.Body)
+}
+
+func loadJobPackageControls(cache *debCache, jobUrl string, pkgs []*jobPackage) {
+	for _, pkg := range pkgs {
+		var err error
+		pkg.control, err = getArtifactControl(cache, jobUrl, pkg.artifact)
+		if err != nil {
+			log.Printf("WARN: failed to read control of %s: %v\n", pkg.key, err)
+		}
+	}
+}
+
+// findSibling 查找依赖关系中的包名对应的同一个 job 中的包，
+// 依赖的包与依赖它的包的架构相同，或者是 all 的。
+func findSibling(pkgMap map[string]*jobPackage, name, arch string) *jobPackage {
+	key, err := getPkgKey(name, arch)
+	if err == nil {
+		if sibling, ok := pkgMap[key]; ok {
+			return sibling
+		}
+	}
+	if sibling, ok := pkgMap[name]; ok && sibling.arch == archAll {
+		return sibling
+	}
+	return nil
+}
+
+// getRequiredSiblings 返回 pkg 一定需要的同一个 job 中的包，以及相应的依赖关系。
+// 只考虑 Depends 和 Pre-Depends 中没有可选项，并且用 = 限定了 job 构建的版本的依赖。
+func getRequiredSiblings(pkg *jobPackage, pkgMap map[string]*jobPackage) ([]*jobPackage, []string) {
+	if pkg.control == nil {
+		return nil, nil
+	}
+	var siblings []*jobPackage
+	var reasons []string
+	for _, field := range []string{"Pre-Depends", "Depends"} {
+		value := pkg.control.Values[field]
+		if value == "" {
+			continue
+		}
+		dep, err := dependency.Parse(value)
+		if err != nil {
+			log.Printf("WARN: failed to parse %s of %s: %v\n", field, pkg.key, err)
+			continue
+		}
+		for _, relation := range dep.Relations {
+			if len(relation.Possibilities) != 1 {
+				continue
+			}
+			possi := relation.Possibilities[0]
+			if possi.Version == nil || possi.Version.Operator != "=" {
+				continue
+			}
+			sibling := findSibling(pkgMap, possi.Name, pkg.arch)
+			if sibling == nil || sibling.control == nil ||
+				sibling.control.Values["Version"] != possi.Version.Number {
+				continue
+			}
+			siblings = append(siblings, sibling)
+			reasons = append(reasons, fmt.Sprintf("%s: %s (= %s)", field, possi.Name, possi.Version.Number))
+		}
+	}
+	return siblings, reasons
+}
+
+// includeRequiredSiblings 把选择的包依赖的包也加入 selected，并说明原因。
+func includeRequiredSiblings(pkgs []*jobPackage, selected map[string]bool) {
+	pkgMap := make(map[string]*jobPackage, len(pkgs))
+	for _, pkg := range pkgs {
+		pkgMap[pkg.key] = pkg
+	}
+
+	var queue []*jobPackage
+	for _, pkg := range pkgs {
+		if selected[pkg.key] {
+			queue = append(queue, pkg)
+		}
+	}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		siblings, reasons := getRequiredSiblings(pkg, pkgMap)
+		for idx, sibling := range siblings {
+			if selected[sibling.key] {
+				continue
+			}
+			fmt.Printf("include %s, required by %s (%s)\n", sibling.key, pkg.key, reasons[idx])
+			selected[sibling.key] = true
+			queue = append(queue, sibling)
+		}
+	}
+}
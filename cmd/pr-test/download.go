@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const defaultDownloadJobs = 4
+const downloadRetryTimes = 3
+
+// downloadDebs 并发下载 deb 文件到 dir 目录，返回的文件名与 artifacts 一一对应。
+func downloadDebs(artifacts []*debArtifact, dir string) ([]string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := getConfig().Download.Jobs
+	if jobs > len(artifacts) {
+		jobs = len(artifacts)
+	}
+
+	board := newProgressBoard()
+	bars := make([]*progressBar, len(artifacts))
+	for idx, artifact := range artifacts {
+		base, err := getUrlBasename(artifact.url)
+		if err != nil {
+			return nil, err
+		}
+		bars[idx] = board.add(base)
+	}
+
+	filenames := make([]string, len(artifacts))
+	errs := make([]error, len(artifacts))
+	taskCh := make(chan int)
+	var wg sync.WaitGroup
+	board.start()
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range taskCh {
+				filenames[idx], errs[idx] = downloadDeb(artifacts[idx], dir, bars[idx])
+				bars[idx].finish(errs[idx])
+			}
+		}()
+	}
+	for idx := range artifacts {
+		taskCh <- idx
+	}
+	close(taskCh)
+	wg.Wait()
+	board.stop()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filenames, nil
+}
+
+// downloadDeb 先下载到 .part 文件，校验通过后再改名。
+// 如果 .part 文件已经存在，就从断点处继续下载。
+func downloadDeb(artifact *debArtifact, dir string, bar *progressBar) (string, error) {
+	base, err := getUrlBasename(artifact.url)
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, base)
+	partFilename := filename + ".part"
+	u := artifact.url.String()
+
+	for i := 0; i < downloadRetryTimes; i++ {
+		debug("download from", u)
+		err = downloadFile(u, partFilename, bar)
+		if err == nil {
+			err = artifact.verify(partFilename)
+			if err != nil {
+				removeErr := os.Remove(partFilename)
+				if removeErr != nil {
+					log.Println("WARN:", removeErr)
+				}
+			}
+		}
+		if err == nil {
+			break
+		}
+		debugF("failed to download %s: %v\n", base, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", u, err)
+	}
+
+	err = os.Rename(partFilename, filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+var regContentRangeSize = regexp.MustCompile(`/(\d+)$`)
+
+func downloadFile(u, filename string, bar *progressBar) (err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := doHttpRequest(req)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err := resp.Body.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		debugF("resume %s from %d\n", filename, offset)
+	case http.StatusOK:
+		offset = 0
+		err = f.Truncate(0)
+		if err != nil {
+			return
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Content-Range: bytes */SIZE，大小一致说明已经下载完了
+		match := regContentRangeSize.FindStringSubmatch(resp.Header.Get("Content-Range"))
+		if match != nil && match[1] == strconv.FormatInt(offset, 10) {
+			bar.reset(offset, offset)
+			return nil
+		}
+		err = f.Truncate(0)
+		if err != nil {
+			return
+		}
+		return errors.New("invalid range of partial file")
+	default:
+		return fmt.Errorf("GET %s: status code %d", u, resp.StatusCode)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	bar.reset(offset, total)
+
+	n, err := io.Copy(f, io.TeeReader(resp.Body, bar))
+	if err != nil {
+		return
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// verify 用 jenkins 提供的校验和检查文件。
+func (artifact *debArtifact) verify(filename string) error {
+	checks := []struct {
+		name string
+		sum  string
+		h    hash.Hash
+	}{
+		{"md5", artifact.md5, md5.New()},
+		{"sha256", artifact.sha256, sha256.New()},
+	}
+
+	var writers []io.Writer
+	for _, check := range checks {
+		if check.sum != "" {
+			writers = append(writers, check.h)
+		}
+	}
+	if len(writers) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+	_, err = io.Copy(io.MultiWriter(writers...), f)
+	if err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		if check.sum == "" {
+			continue
+		}
+		sum := hex.EncodeToString(check.h.Sum(nil))
+		if sum != check.sum {
+			return fmt.Errorf("%s mismatch, expect %s, got %s", check.name, check.sum, sum)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	sh "github.com/codeskyblue/go-sh"
+	"pault.ag/go/debian/version"
+)
+
+// -dry-run 时只下载和修改 deb 包，用 apt-get -s 模拟安装，不会用 sudo 修改系统。
+
+const (
+	aptActionUpgrade   = "upgrade"
+	aptActionDowngrade = "downgrade"
+	aptActionReinstall = "reinstall"
+	aptActionNew       = "new"
+	aptActionRemove    = "remove"
+)
+
+type aptChange struct {
+	action     string
+	pkg        string
+	oldVersion string
+	newVersion string
+}
+
+// Inst dde-daemon [5.12.0.18-1] (5.12.0.19-1 localhost [amd64])
+// Inst libfoo (1.0-1 Debian:10/stable [amd64])
+var regAptInst = regexp.MustCompile(`^Inst (\S+) (?:\[(\S+)\] )?\((\S+)`)
+
+// Remv dde-api [5.1.11.1-1]
+var regAptRemv = regexp.MustCompile(`^Remv (\S+)(?: \[(\S+)\])?`)
+
+func parseAptSimulateOutput(out []byte) []*aptChange {
+	var result []*aptChange
+	for _, line := range bytes.Split(out, []byte{'\n'}) {
+		if match := regAptInst.FindSubmatch(line); match != nil {
+			result = append(result, newAptChange(string(match[1]), string(match[2]), string(match[3])))
+		} else if match := regAptRemv.FindSubmatch(line); match != nil {
+			result = append(result, &aptChange{
+				action:     aptActionRemove,
+				pkg:        string(match[1]),
+				oldVersion: string(match[2]),
+			})
+		}
+	}
+	return result
+}
+
+func newAptChange(pkg, oldVer, newVer string) *aptChange {
+	c := &aptChange{
+		pkg:        pkg,
+		oldVersion: oldVer,
+		newVersion: newVer,
+	}
+	if oldVer == "" {
+		c.action = aptActionNew
+		return c
+	}
+
+	c.action = aptActionUpgrade
+	v1, err1 := version.Parse(oldVer)
+	v2, err2 := version.Parse(newVer)
+	if err1 != nil || err2 != nil {
+		debug("invalid version:", oldVer, newVer)
+		return c
+	}
+	switch n := version.Compare(v2, v1); {
+	case n < 0:
+		c.action = aptActionDowngrade
+	case n == 0:
+		c.action = aptActionReinstall
+	}
+	return c
+}
+
+// simulateInstall 不用 sudo 执行 apt-get -s，apt 允许普通用户模拟安装。
+func simulateInstall(files []string) ([]*aptChange, error) {
+	cmdArgs := []string{"LC_ALL=C", "apt-get", "install", "-s", "-y",
+		"--allow-downgrades", "--reinstall"}
+	cmdArgs = append(cmdArgs, files...)
+	out, err := sh.Command("env", cmdArgs).CombinedOutput()
+	if err != nil {
+		os.Stdout.Write(out)
+		return nil, err
+	}
+	if flagVerbose {
+		os.Stdout.Write(out)
+	}
+	return parseAptSimulateOutput(out), nil
+}
+
+func showArtifacts(jobUrl string, artifacts []*debArtifact) {
+	fmt.Println("artifacts of", jobUrl)
+	for _, artifact := range artifacts {
+		fmt.Println("  ", artifact.url)
+	}
+}
+
+func dryRunInstall(debDetails []*debDetail, files []string) error {
+	fmt.Println("control changes:")
+	for _, d := range debDetails {
+		fmt.Printf("  %s\n", d.pkgName)
+		fmt.Printf("    Version: %s -> %s\n", d.ciVersion, d.newVersion)
+		for _, c := range d.relationChanges {
+			fmt.Printf("    %s: %s\n", c.name, c.oldValue)
+			fmt.Printf("    %s  -> %s\n", strings.Repeat(" ", len(c.name)), c.newValue)
+		}
+	}
+
+	changes, err := simulateInstall(files)
+	if err != nil {
+		return fmt.Errorf("simulate install failed: %v", err)
+	}
+
+	fmt.Println()
+	if len(changes) == 0 {
+		fmt.Println("nothing to install")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tPACKAGE\tFROM\tTO")
+	for _, action := range []string{aptActionUpgrade, aptActionDowngrade, aptActionReinstall,
+		aptActionNew, aptActionRemove} {
+		for _, c := range changes {
+			if c.action == action {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.action, c.pkg, c.oldVersion, c.newVersion)
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -2,52 +2,365 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 
 	gerrit "github.com/andygrunwald/go-gerrit"
 )
 
-func newGerritClient() (*gerrit.Client, error) {
-	client, err := gerrit.NewClient("https://gerrit.uniontech.com", nil)
-	return client, err
+func init() {
+	registerChangeSource(&gerritSource{})
+}
+
+type gerritSource struct {
+	client *gerrit.Client
+}
+
+func (*gerritSource) name() string {
+	return "gerrit"
+}
+
+// match 纯数字的参数，如果当前目录是 github 上 linuxdeepin 仓库的代码目录，则由 github 处理。
+func (*gerritSource) match(arg string) bool {
+	if _, err := strconv.Atoi(arg); err == nil {
+		_, err = getRepoFromGitConfig()
+		return err != nil
+	}
+	if isGerritQuery(arg) || regGerritPatchSetArg.MatchString(arg) {
+		return true
+	}
+	_, err := parseGerritChangeUrl(arg)
+	return err == nil
+}
+
+func (s *gerritSource) getClient() (*gerrit.Client, error) {
+	if s.client == nil {
+		client, err := newGerritClient()
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client, nil
 }
 
-var regUrlSuccess = regexp.MustCompile(`(https://\S+) : SUCCESS`)
+func (s *gerritSource) query(record *installRecord) (*changeStatus, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+	id := strconv.Itoa(record.ChangeNum)
+	if record.ChangeNum == 0 {
+		ref, err := parseGerritChangeUrl(record.ChangeUrl)
+		if err != nil {
+			return nil, err
+		}
+		id = ref.id
+	}
+	changeInfo, _, err := client.Changes.GetChangeDetail(id, &gerrit.ChangeOptions{
+		AdditionalFields: []string{"CURRENT_REVISION"},
+	})
+	if err != nil {
+		return nil, err
+	}
 
-func getJobUrlFromGerritChange(client *gerrit.Client, changeID string) (string, *patchDetail, error) {
-	changeInfo, _, err := client.Changes.GetChangeDetail(changeID, nil)
+	var state string
+	switch changeInfo.Status {
+	case "MERGED":
+		state = changeStateMerged
+	case "ABANDONED":
+		state = changeStateAbandoned
+	default:
+		state = changeStateOpen
+	}
+	return &changeStatus{
+		state:    state,
+		revision: strconv.Itoa(getCurrentPatchSet(changeInfo)),
+	}, nil
+}
+
+func (s *gerritSource) resolve(args []string) ([]*change, error) {
+	_, err := s.getClient()
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
-	detail := &patchDetail{
-		id:    changeID,
-		url:   changeInfo.URL,
-		user:  changeInfo.Owner.Name,
-		title: changeInfo.Subject,
-		state: changeInfo.Status,
+	var refs []gerritChangeRef
+	for _, arg := range args {
+		if isGerritQuery(arg) {
+			ids, err := queryGerritChanges(s.client, arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(ids) == 0 {
+				fmt.Printf("not found change with query %q\n", arg)
+			}
+			for _, id := range ids {
+				refs = append(refs, gerritChangeRef{id: id})
+			}
+			continue
+		}
+
+		ref, err := getGerritChangeRefFromCmdArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+
+	var changes []*change
+	for _, ref := range refs {
+		c, err := getGerritChange(s.client, ref)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func newGerritClient() (*gerrit.Client, error) {
+	cfg := getConfig().Gerrit
+	client, err := gerrit.NewClient(cfg.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Auth {
+	case "":
+	case "basic":
+		client.Authentication.SetBasicAuth(cfg.User, cfg.Password)
+	case "digest":
+		client.Authentication.SetDigestAuth(cfg.User, cfg.Password)
+	case "cookie":
+		fields := strings.SplitN(cfg.Cookie, "=", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid gerrit cookie %q, should be name=value", cfg.Cookie)
+		}
+		client.Authentication.SetCookieAuth(fields[0], fields[1])
+	default:
+		return nil, fmt.Errorf("unknown gerrit auth type %q", cfg.Auth)
 	}
+	return client, nil
+}
+
+// 形如 topic:foo status:open 的参数是 gerrit 的查询语句。
+var regGerritQuery = regexp.MustCompile(`^-?[a-z_]+:\S`)
 
-	var jobUrl string
-	for _, msg := range changeInfo.Messages {
+func isGerritQuery(arg string) bool {
+	return !strings.Contains(arg, "://") && regGerritQuery.MatchString(arg)
+}
+
+func queryGerritChanges(client *gerrit.Client, query string) ([]string, error) {
+	cfg := getConfig().Gerrit
+	if cfg.Project != "" && !strings.Contains(query, "project:") {
+		query += " project:" + cfg.Project
+	}
+	if cfg.Branch != "" && !strings.Contains(query, "branch:") {
+		query += " branch:" + cfg.Branch
+	}
+	debug("gerrit query:", query)
+
+	var result []string
+	opt := &gerrit.QueryChangeOptions{}
+	opt.Query = []string{query}
+	for {
+		changes, _, err := client.Changes.QueryChanges(opt)
+		if err != nil {
+			return nil, err
+		}
+		if changes == nil || len(*changes) == 0 {
+			break
+		}
+		for _, changeInfo := range *changes {
+			result = append(result, strconv.Itoa(changeInfo.Number))
+		}
+		if !(*changes)[len(*changes)-1].MoreChanges {
+			break
+		}
+		opt.Start += len(*changes)
+	}
+	return result, nil
+}
+
+// gerritChangeRef 指向 change 的某个 patch set，patchSet 为 0 表示最新的 patch set。
+type gerritChangeRef struct {
+	id       string
+	patchSet int
+}
+
+// 可以匹配如下几种 change url，末尾可以带上 patch set 的编号：
+// https://gerrit.uniontech.com/c/dde-daemon/+/12345
+// https://gerrit.uniontech.com/c/dde-daemon/+/12345/3
+// https://gerrit.uniontech.com/#/c/12345/
+// https://gerrit.uniontech.com/#/c/12345/3
+// https://gerrit.uniontech.com/12345
+var regGerritChangeUrl = regexp.MustCompile(`(?:/\+/|/#/c/|^https?://[^/]+/)(\d+)(?:/(\d+))?/?$`)
+
+// 匹配 12345/3
+var regGerritPatchSetArg = regexp.MustCompile(`^(\d+)/(\d+)$`)
+
+func parseGerritChangeUrl(changeUrl string) (gerritChangeRef, error) {
+	gerritUrl := strings.TrimSuffix(getConfig().Gerrit.Url, "/")
+	if !strings.HasPrefix(changeUrl, gerritUrl+"/") {
+		return gerritChangeRef{}, errors.New("invalid gerrit change url")
+	}
+	match := regGerritChangeUrl.FindStringSubmatch(changeUrl)
+	if match == nil {
+		return gerritChangeRef{}, errors.New("invalid gerrit change url")
+	}
+	return newGerritChangeRef(match[1], match[2])
+}
+
+func newGerritChangeRef(id, patchSet string) (ref gerritChangeRef, err error) {
+	ref.id = id
+	if patchSet != "" {
+		ref.patchSet, err = strconv.Atoi(patchSet)
+	}
+	return
+}
+
+func getGerritChangeRefFromCmdArg(arg string) (gerritChangeRef, error) {
+	if _, err := strconv.Atoi(arg); err == nil {
+		return gerritChangeRef{id: arg}, nil
+	}
+	match := regGerritPatchSetArg.FindStringSubmatch(arg)
+	if match != nil {
+		return newGerritChangeRef(match[1], match[2])
+	}
+	return parseGerritChangeUrl(arg)
+}
+
+// jenkins 的评论类似于：
+// "Patch Set 1:\n\nBuild Started https://jenkinswh.uniontech.com/job/gerrit-pipeline/1750/"
+// "Patch Set 1: Verified+1 Code-Review+1\n\nBuild Successful \n\nhttps://jenkinswh.uniontech.com/job/gerrit-pipeline/1750/ : SUCCESS"
+// "Patch Set 2: Verified-1\n\nBuild Failed \n\nhttps://jenkinswh.uniontech.com/job/gerrit-pipeline/1760/ : FAILURE"
+var regJobResult = regexp.MustCompile(`(https://\S+) : ([A-Z_]+)`)
+var regJobStarted = regexp.MustCompile(`Build Started (https://\S+)`)
+var regPatchSet = regexp.MustCompile(`^Patch Set (\d+)`)
+
+type jenkinsJobResult struct {
+	url    string
+	result string // 为空表示还在构建中
+}
+
+func getMessagePatchSet(msg *gerrit.ChangeMessageInfo) int {
+	if msg.RevisionNumber != 0 {
+		return msg.RevisionNumber
+	}
+	match := regPatchSet.FindStringSubmatch(msg.Message)
+	if match == nil {
+		return 0
+	}
+	num, _ := strconv.Atoi(match[1])
+	return num
+}
+
+// getPatchSetJobResults 返回 jenkins 对 patch set 的最后一次构建的结果。
+func getPatchSetJobResults(changeInfo *gerrit.ChangeInfo, patchSet int) []jenkinsJobResult {
+	var results []jenkinsJobResult
+	for idx := range changeInfo.Messages {
+		msg := &changeInfo.Messages[idx]
 		if msg.Author.Name != "jenkins" {
 			continue
 		}
+		if getMessagePatchSet(msg) != patchSet {
+			continue
+		}
+
+		if match := regJobStarted.FindStringSubmatch(msg.Message); match != nil {
+			results = []jenkinsJobResult{{url: match[1]}}
+			continue
+		}
 
-		// author 都是 jenkins
-		//"Patch Set 1: Verified+1 Code-Review+1\n\nBuild Successful \n\nhttps://jenkinswh.uniontech.com/job/gerrit-pipeline/1750/ : SUCCESS"
-		match := regUrlSuccess.FindStringSubmatch(msg.Message)
-		if match != nil {
-			jobUrl0 := match[1]
-			_, err := url.Parse(jobUrl0)
-			if err == nil {
-				jobUrl = jobUrl0
+		allMatch := regJobResult.FindAllStringSubmatch(msg.Message, -1)
+		if allMatch == nil {
+			continue
+		}
+		results = nil
+		for _, match := range allMatch {
+			_, err := url.Parse(match[1])
+			if err != nil {
+				continue
 			}
+			results = append(results, jenkinsJobResult{url: match[1], result: match[2]})
 		}
 	}
-	if jobUrl == "" {
-		return "", nil, errors.New("not found job url")
+	return results
+}
+
+func getCurrentPatchSet(changeInfo *gerrit.ChangeInfo) int {
+	if rev, ok := changeInfo.Revisions[changeInfo.CurrentRevision]; ok {
+		return rev.Number
+	}
+	var patchSet int
+	for idx := range changeInfo.Messages {
+		num := getMessagePatchSet(&changeInfo.Messages[idx])
+		if num > patchSet {
+			patchSet = num
+		}
+	}
+	return patchSet
+}
+
+func getGerritChange(client *gerrit.Client, ref gerritChangeRef) (*change, error) {
+	changeInfo, _, err := client.Changes.GetChangeDetail(ref.id, &gerrit.ChangeOptions{
+		AdditionalFields: []string{"CURRENT_REVISION"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	patchSet := ref.patchSet
+	currentPatchSet := getCurrentPatchSet(changeInfo)
+	if patchSet == 0 {
+		patchSet = currentPatchSet
+	} else if currentPatchSet != 0 && patchSet > currentPatchSet {
+		return nil, fmt.Errorf("change %s has no patch set %d, the latest is %d",
+			ref.id, patchSet, currentPatchSet)
+	}
+
+	changeUrl := changeInfo.URL
+	if changeUrl == "" {
+		changeUrl = fmt.Sprintf("%s/c/%s/+/%d", strings.TrimSuffix(getConfig().Gerrit.Url, "/"),
+			changeInfo.Project, changeInfo.Number)
+	}
+	detail := &patchDetail{
+		backend:  "gerrit",
+		id:       ref.id,
+		url:      changeUrl,
+		repo:     changeInfo.Project,
+		num:      changeInfo.Number,
+		user:     changeInfo.Owner.Name,
+		title:    changeInfo.Subject,
+		state:    changeInfo.Status,
+		revision: strconv.Itoa(patchSet),
+	}
+	fmt.Printf("> change %d patch set %d\n", changeInfo.Number, patchSet)
+
+	results := getPatchSetJobResults(changeInfo, patchSet)
+	if len(results) == 0 {
+		return nil, fmt.Errorf("not found job url of patch set %d", patchSet)
+	}
+
+	var jobUrls []string
+	for _, result := range results {
+		switch result.result {
+		case jenkinsResultSuccess:
+			jobUrls = append(jobUrls, result.url)
+		case "":
+			return nil, fmt.Errorf("build of patch set %d is still running, please see %s",
+				patchSet, result.url)
+		default:
+			return nil, fmt.Errorf("build of patch set %d result is %s, please see %s",
+				patchSet, result.result, result.url)
+		}
 	}
-	return jobUrl, detail, nil
+	return &change{
+		detail:  detail,
+		jobUrls: jobUrls,
+	}, nil
 }
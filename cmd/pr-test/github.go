@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	sh "github.com/codeskyblue/go-sh"
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	registerChangeSource(&githubSource{})
+}
+
+type githubSource struct{}
+
+func (*githubSource) name() string {
+	return "github"
+}
+
+func (*githubSource) query(record *installRecord) (*changeStatus, error) {
+	prId := pullRequestId{repo: record.Repo, num: record.ChangeNum}
+	if prId.repo == "" || prId.num == 0 {
+		var err error
+		prId, err = parsePullUrl(record.ChangeUrl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pr, err := getPullRequest(getGithubClient(), prId.repo, prId.num)
+	if err != nil {
+		return nil, err
+	}
+	state := pr.GetState()
+	if pr.GetMerged() {
+		state = changeStateMerged
+	}
+	return &changeStatus{
+		state:    state,
+		revision: pr.GetHead().GetSHA(),
+	}, nil
+}
+
+var regGithubShortArg = regexp.MustCompile(`^@?[^#\s]+#\d+$`)
+
+func (*githubSource) match(arg string) bool {
+	if _, err := strconv.Atoi(arg); err == nil {
+		_, err = getRepoFromGitConfig()
+		return err == nil
+	}
+	return strings.HasPrefix(arg, "https://github.com/") ||
+		regGithubShortArg.MatchString(arg)
+}
+
+func (*githubSource) resolve(args []string) ([]*change, error) {
+	client := getGithubClient()
+	var prIds []pullRequestId
+	for _, arg := range args {
+		ids, err := getPrIdsFromCmdArg(client, arg)
+		if err != nil {
+			return nil, err
+		}
+		prIds = append(prIds, ids...)
+	}
+	if len(prIds) == 0 {
+		return nil, nil
+	}
+
+	allPrIds := prIds
+	if flagAllPrs {
+		prIds = dedupPrIds(prIds)
+	} else {
+		prIds = uniqPrIds(prIds)
+	}
+	prIdsStrList := make([]string, len(prIds))
+	for idx, id := range prIds {
+		prIdsStrList[idx] = id.String()
+	}
+	debug("found pull request:", strings.Join(prIdsStrList, ", "))
+	err := showPullRequestTable(client, allPrIds, prIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*change
+	for _, prId := range prIds {
+		c, err := getPullRequestChange(client, prId)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+var globalClient *github.Client
+
+func getGithubClient() *github.Client {
+	if globalClient != nil {
+		return globalClient
+	}
+
+	token, err := getGithubAccessToken()
+	if err != nil {
+		log.Println("WARN: failed to get github access token:", err)
+	}
+
+	ctx := context.Background()
+	var httpClient *http.Client
+	if token != "" {
+		httpClient = oauth2.NewClient(ctx, oauth2.StaticTokenSource(
+			&oauth2.Token{
+				AccessToken: token,
+			}))
+	}
+	client := github.NewClient(httpClient)
+	globalClient = client
+	return client
+}
+
+func getPrIdsFromCmdArg(client *github.Client, arg string) ([]pullRequestId, error) {
+	issueShortReg := regexp.MustCompile(`^@([^#]+)#(\d+)$`)
+	// match @xxx#37
+	match := issueShortReg.FindStringSubmatch(arg)
+	if match != nil {
+		repo := match[1]
+		num, err := strconv.Atoi(match[2])
+		if err != nil {
+			return nil, err
+		}
+		switch repo {
+		case "id":
+			repo = "internal-discussion"
+		case "dc":
+			repo = "developer-center"
+		}
+		arg1 := fmt.Sprintf("https://github.com/%s/%s/issues/%d", organization, repo, num)
+		arg = arg1
+	}
+
+	if strings.Contains(arg, "/issues/") {
+		return getPrIdsWithIssue(client, arg)
+	}
+	id, err := getPRIdFromCmdArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	return []pullRequestId{id}, nil
+}
+
+var globalPRCache = make(map[pullRequestId]*github.PullRequest)
+
+func getPullRequest(client *github.Client, repo string, num int) (*github.PullRequest, error) {
+	pr := globalPRCache[pullRequestId{repo: repo, num: num}]
+	if pr != nil {
+		return pr, nil
+	}
+
+	ctx := context.Background()
+	pr, _, err := client.PullRequests.Get(ctx, organization, repo, num)
+	if err != nil {
+		return nil, err
+	}
+
+	globalPRCache[pullRequestId{repo: repo, num: num}] = pr
+	return pr, nil
+}
+
+// go-github v17 的 Timeline.Source 中没有 issue 字段，只好自己定义。
+type issueTimelineEvent struct {
+	Event  string `json:"event"`
+	Source *struct {
+		Issue *github.Issue `json:"issue"`
+	} `json:"source"`
+}
+
+func listIssueTimeline(client *github.Client, iId issueId, page int) ([]*issueTimelineEvent, *github.Response, error) {
+	u := fmt.Sprintf("repos/%s/%s/issues/%d/timeline?page=%d&per_page=100",
+		iId.owner, iId.repo, iId.num, page)
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.mockingbird-preview+json")
+
+	var events []*issueTimelineEvent
+	resp, err := client.Do(context.Background(), req, &events)
+	return events, resp, err
+}
+
+func getPrIdsWithIssue(client *github.Client, issueUrl string) ([]pullRequestId, error) {
+	iId, err := parseIssueUrl(issueUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	page := 1
+	var prIds []pullRequestId
+	for {
+		timeline, resp, err := listIssueTimeline(client, iId, page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, timelineItem := range timeline {
+			if timelineItem.Event != "cross-referenced" || timelineItem.Source == nil {
+				continue
+			}
+			issue := timelineItem.Source.Issue
+			if issue == nil || !issue.IsPullRequest() {
+				continue
+			}
+			prId, err := parsePullUrl(issue.PullRequestLinks.GetHTMLURL())
+			if err != nil {
+				debug("ignore pull request:", issue.PullRequestLinks.GetHTMLURL())
+				continue
+			}
+			if pullRequestIdsContain(prIds, prId) {
+				continue
+			}
+
+			pr, err := getPullRequest(client, prId.repo, prId.num)
+			if err != nil {
+				return nil, err
+			}
+			if pr.GetState() == "closed" && !pr.GetMerged() {
+				debug("ignore abandoned:", prId.String())
+				continue
+			}
+			prIds = append(prIds, prId)
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	if len(prIds) == 0 {
+		fmt.Printf("not found pull request in issue %s/%s#%d\n", iId.owner, iId.repo, iId.num)
+	}
+	return prIds, nil
+}
+
+func pullRequestIdsContain(ids []pullRequestId, id pullRequestId) bool {
+	for _, value := range ids {
+		if value == id {
+			return true
+		}
+	}
+	return false
+}
+
+type pullRequestId struct {
+	repo string
+	num  int
+}
+
+func (prId pullRequestId) String() string {
+	return fmt.Sprintf("%s#%d", prId.repo, prId.num)
+}
+
+// uniqPrIds 只保留每个仓库中编号最大的 pull request。
+func uniqPrIds(ids []pullRequestId) (result []pullRequestId) {
+	repoNumsMap := make(map[string][]int)
+	for _, id := range ids {
+		repoNumsMap[id.repo] = append(repoNumsMap[id.repo], id.num)
+	}
+
+	for repo, nums := range repoNumsMap {
+		sort.Ints(nums)
+		num := nums[len(nums)-1]
+		result = append(result, pullRequestId{repo: repo, num: num})
+	}
+	sortPrIds(result)
+	return
+}
+
+// dedupPrIds 去掉重复的 pull request，保留全部。
+func dedupPrIds(ids []pullRequestId) (result []pullRequestId) {
+	for _, id := range ids {
+		if !pullRequestIdsContain(result, id) {
+			result = append(result, id)
+		}
+	}
+	sortPrIds(result)
+	return
+}
+
+func sortPrIds(ids []pullRequestId) {
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].repo != ids[j].repo {
+			return ids[i].repo < ids[j].repo
+		}
+		return ids[i].num < ids[j].num
+	})
+}
+
+func showPullRequestTable(client *github.Client, all, selected []pullRequestId) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PULL REQUEST\tSTATE\tUSER\tINSTALL\tTITLE")
+	for _, prId := range dedupPrIds(all) {
+		pr, err := getPullRequest(client, prId.repo, prId.num)
+		if err != nil {
+			return err
+		}
+		state := pr.GetState()
+		if pr.GetMerged() {
+			state = "merged"
+		}
+		install := "no"
+		if pullRequestIdsContain(selected, prId) {
+			install = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", prId, state, pr.GetUser().GetLogin(),
+			install, pr.GetTitle())
+	}
+	return tw.Flush()
+}
+
+func getPRIdFromCmdArg(arg string) (pullRequestId, error) {
+	num, err := strconv.Atoi(arg)
+	if err == nil {
+		repo, err := getRepoFromGitConfig()
+		if err != nil {
+			return pullRequestId{}, err
+		}
+		return pullRequestId{repo: repo, num: num}, nil
+	}
+	reg := regexp.MustCompile(`^(\S+)#(\d+)$`)
+	match := reg.FindStringSubmatch(arg)
+	if match != nil {
+		repo := match[1]
+		num, err := strconv.Atoi(match[2])
+		if err != nil {
+			return pullRequestId{}, err
+		}
+		return pullRequestId{repo: repo, num: num}, nil
+	}
+
+	return parsePullUrl(arg)
+}
+
+func getRepoFromGitConfig() (string, error) {
+	out, err := sh.Command("git", "config", "--local",
+		"--get-regexp", `remote\..*\.url`).Output()
+	if err != nil {
+		return "", err
+	}
+	remotes := bytes.Split(out, []byte("\n"))
+	reg := regexp.MustCompile(fmt.Sprintf(`github.com[:/]%s/(.+)$`, organization))
+	for _, remote := range remotes {
+		match := reg.FindSubmatch(remote)
+		if match != nil {
+			repo := string(match[1])
+			repo = strings.TrimSuffix(repo, ".git")
+			return repo, nil
+		}
+	}
+	return "", errors.New("repo not found in remote urls")
+}
+
+func getSuccessStatus(statuses []*github.RepoStatus) *github.RepoStatus {
+	for _, status := range statuses {
+		if status.GetState() == "success" {
+			return status
+		}
+	}
+	return nil
+}
+
+func parsePullUrl(pullUrl string) (prId pullRequestId, err error) {
+	reg := regexp.MustCompile("https://github.com/" + organization + `/([^/]+)/pull/(\d+)`)
+	match := reg.FindStringSubmatch(pullUrl)
+	if match == nil {
+		err = errors.New("invalid pull url")
+		return
+	}
+
+	prId.repo = match[1]
+	prId.num, err = strconv.Atoi(match[2])
+	return
+}
+
+type issueId struct {
+	owner string
+	repo  string
+	num   int
+}
+
+func parseIssueUrl(issueUrl string) (iId issueId, err error) {
+	reg := regexp.MustCompile(`https://github.com/([^/]+)/([^/]+)/issues/(\d+)`)
+	match := reg.FindStringSubmatch(issueUrl)
+	if match == nil {
+		err = errors.New("invalid issue url")
+		return
+	}
+
+	iId.owner = match[1]
+	iId.repo = match[2]
+	iId.num, err = strconv.Atoi(match[3])
+	return
+}
+
+func showPullRequestInfo(prId pullRequestId, pr *github.PullRequest) {
+	fmt.Printf("> %s #%d\n", prId.repo, prId.num)
+	fmt.Println("title:", pr.GetTitle())
+	fmt.Println("state:", pr.GetState())
+	fmt.Println("merged:", pr.GetMerged())
+	fmt.Println("user:", pr.GetUser().GetLogin())
+}
+
+type pullRequestDetail struct {
+	pullRequestId
+	url   string
+	user  string
+	title string
+	state string
+}
+
+func getPullRequestChange(client *github.Client, prId pullRequestId) (*change, error) {
+	ctx := context.Background()
+	pr, err := getPullRequest(client, prId.repo, prId.num)
+	if err != nil {
+		return nil, err
+	}
+
+	showPullRequestInfo(prId, pr)
+
+	prRef := pr.GetHead().GetSHA()
+	if prRef == "" {
+		return nil, errors.New("failed to get pull request ref")
+	}
+	statuses, _, err := client.Repositories.ListStatuses(ctx, organization, prId.repo,
+		prRef, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	status := getSuccessStatus(statuses)
+	if status == nil {
+		var targetUrl0 string
+		for _, status := range statuses {
+			targetUrl := status.GetTargetURL()
+			if targetUrl != "" {
+				targetUrl0 = targetUrl
+			}
+			break
+		}
+
+		errMsg := "not found success status"
+		if targetUrl0 != "" {
+			errMsg += ", please see " + targetUrl0
+		}
+		return nil, errors.New(errMsg)
+	}
+
+	targetUrl := status.GetTargetURL()
+	if targetUrl == "" {
+		return nil, errors.New("target url is empty")
+	}
+
+	debug("targetUrl:", targetUrl)
+
+	detail := &patchDetail{
+		backend: "github",
+		id:      strconv.Itoa(int(pr.GetID())),
+		url:     pr.GetHTMLURL(),
+		repo:    prId.repo,
+		num:     prId.num,
+		user:    pr.GetUser().GetLogin(),
+		title:   pr.GetTitle(),
+		state:   pr.GetState(),
+
+		revision: prRef,
+	}
+	jobUrl := strings.TrimSuffix(targetUrl, "/console")
+	return &change{
+		detail:  detail,
+		jobUrls: []string{jobUrl},
+	}, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/levigross/grequests"
+)
+
+// 通过 jenkins 的 json api 获取构建结果和构建产物。
+
+const jenkinsBuildTree = "_class,url,result,building," +
+	"artifacts[fileName,relativePath],fingerprint[fileName,hash]," +
+	"subBuilds[url,result,jobName,buildNumber]," +
+	"actions[triggeredBuilds[url,result],downstreamBuilds[jobFullName,buildNumber]]"
+
+// 下游构建的最大层数
+const jenkinsMaxBuildDepth = 3
+
+const (
+	jenkinsResultSuccess  = "SUCCESS"
+	jenkinsResultUnstable = "UNSTABLE"
+
+	jenkinsClassWorkflowRun = "org.jenkinsci.plugins.workflow.job.WorkflowRun"
+)
+
+type jenkinsBuild struct {
+	Class     string            `json:"_class"`
+	Url       string            `json:"url"`
+	Result    string            `json:"result"`
+	Building  bool              `json:"building"`
+	Artifacts []jenkinsArtifact `json:"artifacts"`
+	// 记录了指纹的文件，hash 为 md5
+	Fingerprint []jenkinsFingerprint `json:"fingerprint"`
+	// multijob 插件触发的构建
+	SubBuilds []jenkinsSubBuild `json:"subBuilds"`
+	Actions   []jenkinsAction   `json:"actions"`
+}
+
+type jenkinsArtifact struct {
+	FileName     string `json:"fileName"`
+	RelativePath string `json:"relativePath"`
+}
+
+type jenkinsFingerprint struct {
+	FileName string `json:"fileName"`
+	Hash     string `json:"hash"`
+}
+
+type jenkinsSubBuild struct {
+	// 相对于 jenkins 根地址
+	Url         string `json:"url"`
+	Result      string `json:"result"`
+	JobName     string `json:"jobName"`
+	BuildNumber int    `json:"buildNumber"`
+}
+
+type jenkinsAction struct {
+	// parameterized-trigger 插件触发的构建
+	TriggeredBuilds []struct {
+		Url    string `json:"url"`
+		Result string `json:"result"`
+	} `json:"triggeredBuilds"`
+	// pipeline 中 build 步骤触发的构建
+	DownstreamBuilds []struct {
+		JobFullName string `json:"jobFullName"`
+		BuildNumber int    `json:"buildNumber"`
+	} `json:"downstreamBuilds"`
+}
+
+type jenkinsStage struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func getJenkinsJSON(u string, params map[string]string, v interface{}) error {
+	resp, err := grequests.Get(u, &grequests.RequestOptions{
+		Params: params,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := resp.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+	if !resp.Ok {
+		return fmt.Errorf("GET %s: status code %d", u, resp.StatusCode)
+	}
+	return resp.JSON(v)
+}
+
+func getJenkinsBuild(buildUrl string) (*jenkinsBuild, error) {
+	apiUrl := strings.TrimSuffix(buildUrl, "/") + "/api/json"
+	var build jenkinsBuild
+	err := getJenkinsJSON(apiUrl, map[string]string{"tree": jenkinsBuildTree}, &build)
+	if err != nil {
+		return nil, err
+	}
+	if build.Url == "" {
+		build.Url = buildUrl
+	}
+	if !strings.HasSuffix(build.Url, "/") {
+		build.Url += "/"
+	}
+	return &build, nil
+}
+
+// getJenkinsStages 获取 pipeline 各个 stage 的状态。
+func getJenkinsStages(build *jenkinsBuild) ([]jenkinsStage, error) {
+	var describe struct {
+		Stages []jenkinsStage `json:"stages"`
+	}
+	err := getJenkinsJSON(build.Url+"wfapi/describe", nil, &describe)
+	if err != nil {
+		return nil, err
+	}
+	return describe.Stages, nil
+}
+
+// getJenkinsRootUrl 从构建的 url 得到 jenkins 的根地址，
+// 比如 https://ci.deepin.io/job/github-pr-check/16/ 得到 https://ci.deepin.io/。
+func getJenkinsRootUrl(buildUrl string) string {
+	idx := strings.Index(buildUrl, "/job/")
+	if idx == -1 {
+		return buildUrl
+	}
+	return buildUrl[:idx+1]
+}
+
+func (build *jenkinsBuild) getDownstreamUrls() []string {
+	root := getJenkinsRootUrl(build.Url)
+	var result []string
+	for _, subBuild := range build.SubBuilds {
+		if subBuild.Url != "" {
+			result = append(result, root+strings.TrimPrefix(subBuild.Url, "/"))
+		}
+	}
+	for _, action := range build.Actions {
+		for _, triggered := range action.TriggeredBuilds {
+			if triggered.Url != "" {
+				result = append(result, triggered.Url)
+			}
+		}
+		for _, downstream := range action.DownstreamBuilds {
+			if downstream.JobFullName == "" {
+				continue
+			}
+			jobPath := "job/" + strings.Join(strings.Split(downstream.JobFullName, "/"), "/job/")
+			result = append(result, root+jobPath+"/"+strconv.Itoa(downstream.BuildNumber)+"/")
+		}
+	}
+	return result
+}
+
+func (build *jenkinsBuild) getArtifactUrl(artifact jenkinsArtifact) (*url.URL, error) {
+	parts := strings.Split(artifact.RelativePath, "/")
+	for idx, part := range parts {
+		parts[idx] = url.PathEscape(part)
+	}
+	return url.Parse(build.Url + "artifact/" + strings.Join(parts, "/"))
+}
+
+// getSha256Sums 从构建产物中的 *.sha256 和 SHA256SUMS 文件中读取 sha256 校验和，
+// 返回文件名到校验和的映射。
+func (build *jenkinsBuild) getSha256Sums() map[string]string {
+	result := make(map[string]string)
+	for _, artifact := range build.Artifacts {
+		if !strings.HasSuffix(artifact.FileName, ".sha256") &&
+			artifact.FileName != "SHA256SUMS" {
+			continue
+		}
+		u, err := build.getArtifactUrl(artifact)
+		if err != nil {
+			continue
+		}
+		resp, err := grequests.Get(u.String(), nil)
+		if err != nil {
+			log.Println("WARN:", err)
+			continue
+		}
+		if !resp.Ok {
+			log.Printf("WARN: GET %s: status code %d\n", u, resp.StatusCode)
+			continue
+		}
+
+		// 每行的格式为“校验和  文件名”，*.sha256 文件中可能只有校验和
+		defaultName := strings.TrimSuffix(artifact.FileName, ".sha256")
+		for _, line := range strings.Split(resp.String(), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			name := defaultName
+			if len(fields) > 1 {
+				name = path.Base(strings.TrimPrefix(fields[1], "*"))
+			}
+			result[name] = strings.ToLower(fields[0])
+		}
+	}
+	return result
+}
+
+// checkResult 检查构建的结果，构建中或者失败都会返回错误。
+func (build *jenkinsBuild) checkResult() error {
+	if build.Building {
+		return fmt.Errorf("job is still running, please see %s", build.Url)
+	}
+	switch build.Result {
+	case jenkinsResultSuccess:
+		return nil
+	case jenkinsResultUnstable:
+		log.Printf("WARN: job result is %s, see %s\n", build.Result, build.Url)
+		return nil
+	}
+
+	errMsg := fmt.Sprintf("job result is %s", build.Result)
+	if build.Class == jenkinsClassWorkflowRun {
+		stages, err := getJenkinsStages(build)
+		if err != nil {
+			debug("failed to get stages:", err)
+		}
+		var failedStages []string
+		for _, stage := range stages {
+			if stage.Status != jenkinsResultSuccess && stage.Status != "NOT_EXECUTED" {
+				failedStages = append(failedStages, stage.Name+"("+stage.Status+")")
+			}
+		}
+		if len(failedStages) > 0 {
+			errMsg += ", stages: " + strings.Join(failedStages, ", ")
+		}
+	}
+	return errors.New(errMsg + ", please see " + build.Url)
+}
+
+// getJenkinsDebArtifacts 获取构建及其下游构建中所有的 deb 文件。
+func getJenkinsDebArtifacts(build *jenkinsBuild) ([]*debArtifact, error) {
+	visited := make(map[string]bool)
+	var result []*debArtifact
+
+	var walk func(build *jenkinsBuild, depth int) error
+	walk = func(build *jenkinsBuild, depth int) error {
+		if visited[build.Url] {
+			return nil
+		}
+		visited[build.Url] = true
+
+		err := build.checkResult()
+		if err != nil {
+			return err
+		}
+
+		md5Sums := make(map[string]string)
+		for _, fingerprint := range build.Fingerprint {
+			md5Sums[fingerprint.FileName] = strings.ToLower(fingerprint.Hash)
+		}
+		sha256Sums := build.getSha256Sums()
+
+		for _, artifact := range build.Artifacts {
+			if !strings.HasSuffix(artifact.FileName, ".deb") {
+				continue
+			}
+			u, err := build.getArtifactUrl(artifact)
+			if err != nil {
+				return err
+			}
+			result = append(result, &debArtifact{
+				url:    u,
+				md5:    md5Sums[artifact.FileName],
+				sha256: sha256Sums[artifact.FileName],
+			})
+		}
+
+		if depth >= jenkinsMaxBuildDepth {
+			return nil
+		}
+		for _, downstreamUrl := range build.getDownstreamUrls() {
+			debug("downstream build:", downstreamUrl)
+			downstream, err := getJenkinsBuild(downstreamUrl)
+			if err != nil {
+				log.Println("WARN: failed to get downstream build:", err)
+				continue
+			}
+			err = walk(downstream, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(build, 0)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
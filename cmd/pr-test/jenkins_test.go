@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newFakeJenkins 返回一个假的 jenkins，pages 的 key 为路径，value 中的 {{root}} 会被替换为服务器的地址。
+func newFakeJenkins(t *testing.T, pages map[string]string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			t.Logf("not found %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = fmt.Fprint(w, strings.Replace(page, "{{root}}", srv.URL, -1))
+	}))
+	return srv
+}
+
+func TestGetJenkinsDebArtifacts(t *testing.T) {
+	srv := newFakeJenkins(t, map[string]string{
+		"/job/pr-check/16/api/json": `{
+			"_class": "org.jenkinsci.plugins.workflow.job.WorkflowRun",
+			"url": "{{root}}/job/pr-check/16/",
+			"result": "SUCCESS",
+			"artifacts": [
+				{"fileName": "a_1.0-1_amd64.deb", "relativePath": "debs/amd64/a_1.0-1_amd64.deb"},
+				{"fileName": "SHA256SUMS", "relativePath": "SHA256SUMS"},
+				{"fileName": "build.log", "relativePath": "build.log"}
+			],
+			"fingerprint": [{"fileName": "a_1.0-1_amd64.deb", "hash": "0123456789ABCDEF0123456789ABCDEF"}],
+			"subBuilds": [{"url": "job/sub/3/", "result": "SUCCESS", "jobName": "sub", "buildNumber": 3}],
+			"actions": [
+				{},
+				{"triggeredBuilds": [{"url": "{{root}}/job/trig/5/", "result": "SUCCESS"}]},
+				{"downstreamBuilds": [{"jobFullName": "folder/down", "buildNumber": 7}]}
+			]
+		}`,
+		"/job/pr-check/16/artifact/SHA256SUMS": "AAAA  debs/amd64/a_1.0-1_amd64.deb\n",
+		"/job/sub/3/api/json": `{
+			"url": "{{root}}/job/sub/3/",
+			"result": "SUCCESS",
+			"artifacts": [
+				{"fileName": "b_1.0-1_all.deb", "relativePath": "b_1.0-1_all.deb"},
+				{"fileName": "b_1.0-1_all.deb.sha256", "relativePath": "b_1.0-1_all.deb.sha256"}
+			]
+		}`,
+		"/job/sub/3/artifact/b_1.0-1_all.deb.sha256": "bbbb\n",
+		// 指回上游的构建不会重复处理
+		"/job/trig/5/api/json": `{
+			"url": "{{root}}/job/trig/5/",
+			"result": "SUCCESS",
+			"artifacts": [{"fileName": "c_1.0-1_i386.deb", "relativePath": "out/c_1.0-1_i386.deb"}],
+			"actions": [{"triggeredBuilds": [{"url": "{{root}}/job/pr-check/16/"}]}]
+		}`,
+		"/job/folder/job/down/7/api/json": `{
+			"url": "{{root}}/job/folder/job/down/7/",
+			"result": "UNSTABLE",
+			"artifacts": [{"fileName": "d_1.0-1_amd64.deb", "relativePath": "d_1.0-1_amd64.deb"}]
+		}`,
+	})
+	defer srv.Close()
+
+	build, err := getJenkinsBuild(srv.URL + "/job/pr-check/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err := getJenkinsDebArtifacts(build)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		url, md5, sha256 string
+	}
+	var got []result
+	for _, a := range artifacts {
+		got = append(got, result{strings.TrimPrefix(a.url.String(), srv.URL), a.md5, a.sha256})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].url < got[j].url })
+	want := []result{
+		{"/job/folder/job/down/7/artifact/d_1.0-1_amd64.deb", "", ""},
+		{"/job/pr-check/16/artifact/debs/amd64/a_1.0-1_amd64.deb", "0123456789abcdef0123456789abcdef", "aaaa"},
+		{"/job/sub/3/artifact/b_1.0-1_all.deb", "", "bbbb"},
+		{"/job/trig/5/artifact/out/c_1.0-1_i386.deb", "", ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("artifact %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestJenkinsCheckResult(t *testing.T) {
+	srv := newFakeJenkins(t, map[string]string{
+		"/job/pipeline/2/wfapi/describe": `{"stages": [
+			{"name": "Checkout", "status": "SUCCESS"},
+			{"name": "Build", "status": "FAILED"},
+			{"name": "Upload", "status": "NOT_EXECUTED"}
+		]}`,
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		build   jenkinsBuild
+		wantErr []string
+	}{
+		{
+			name:    "building",
+			build:   jenkinsBuild{Url: srv.URL + "/job/pr-check/1/", Building: true},
+			wantErr: []string{"still running", "/job/pr-check/1/"},
+		},
+		{
+			name: "failure with stages",
+			build: jenkinsBuild{Url: srv.URL + "/job/pipeline/2/", Result: "FAILURE",
+				Class: jenkinsClassWorkflowRun},
+			wantErr: []string{"FAILURE", "Build(FAILED)", "/job/pipeline/2/"},
+		},
+		{
+			name:    "failure",
+			build:   jenkinsBuild{Url: srv.URL + "/job/freestyle/3/", Result: "FAILURE"},
+			wantErr: []string{"FAILURE", "/job/freestyle/3/"},
+		},
+		{
+			name:  "unstable",
+			build: jenkinsBuild{Url: srv.URL + "/job/pr-check/4/", Result: "UNSTABLE"},
+		},
+		{
+			name:  "success",
+			build: jenkinsBuild{Url: srv.URL + "/job/pr-check/5/", Result: "SUCCESS"},
+		},
+	}
+	for _, test := range tests {
+		err := test.build.checkResult()
+		if len(test.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expect error", test.name)
+			continue
+		}
+		for _, s := range test.wantErr {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%s: error %q does not contain %q", test.name, err, s)
+			}
+		}
+		if strings.Contains(err.Error(), "Checkout") || strings.Contains(err.Error(), "Upload") {
+			t.Errorf("%s: error %q contains successful stages", test.name, err)
+		}
+	}
+}
+
+func TestGetDebArtifactsFromHtml(t *testing.T) {
+	srv := newFakeJenkins(t, map[string]string{
+		"/job/pr-check/16/": `<a href="artifact/debs/a_1.0_amd64.deb">a_1.0_amd64.deb</a>
+			<a href="artifact/debs/b_1.0_all.deb">b_1.0_all.deb</a>`,
+		"/job/pr-check/17/": `<script>x.href = 'artifact/c_1.0_amd64.deb';</script>`,
+		"/job/pr-check/18/": `<p>no artifacts</p>`,
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		jobUrl string
+		want   []string
+	}{
+		{srv.URL + "/job/pr-check/16/", []string{
+			"/job/pr-check/16/artifact/debs/a_1.0_amd64.deb",
+			"/job/pr-check/16/artifact/debs/b_1.0_all.deb",
+		}},
+		{srv.URL + "/job/pr-check/17/", []string{"/job/pr-check/17/artifact/c_1.0_amd64.deb"}},
+		{srv.URL + "/job/pr-check/18/", nil},
+	}
+	for _, test := range tests {
+		artifacts, err := getDebArtifactsFromHtml(test.jobUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, a := range artifacts {
+			got = append(got, strings.TrimPrefix(a.url.String(), srv.URL))
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got %v, want %v", test.jobUrl, got, test.want)
+		}
+	}
+}
@@ -9,24 +9,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	sh "github.com/codeskyblue/go-sh"
-	"github.com/google/go-github/github"
 	"github.com/levigross/grequests"
-	"golang.org/x/oauth2"
 	"pault.ag/go/debian/control"
-	"pault.ag/go/debian/dependency"
 )
 
 var VERSION = "unknown"
@@ -36,19 +30,63 @@ var flagVerbose bool
 var flagRestore string
 var flagVersion bool
 var flagUpgradeSelf bool
+var flagAllPrs bool
+var flagConfig string
+var flagGerritUrl string
+var flagGerritAuth string
+var flagGerritUser string
+var flagGerritPassword string
+var flagGerritCookie string
+var flagGerritProject string
+var flagGerritBranch string
+var flagDownloadJobs int
+var flagCacheClean bool
+var flagPurge bool
+var flagYes bool
+var flagDryRun bool
+var flagJson bool
+var flagCheck bool
+var flagArch string
+var flagVersionPolicy string
+var flagFormat string
+var flagInclude string
+var flagExclude string
 
 func init() {
 	flag.BoolVar(&flagStatus, "status", false, "")
 	flag.BoolVar(&flagVerbose, "verbose", false, "")
 	flag.BoolVar(&flagVersion, "version", false, "")
 	flag.BoolVar(&flagUpgradeSelf, "upgrade", false, "")
-	flag.StringVar(&flagRestore, "restore", "", "all|$repo|$user")
+	flag.BoolVar(&flagAllPrs, "all-prs", false,
+		"install all pull requests found, not only the latest one of each repo")
+	flag.StringVar(&flagConfig, "config", "", "config file, default ~/.config/deepin-pr-test/config.yaml")
+	flag.StringVar(&flagGerritUrl, "gerrit-url", "", "gerrit server url")
+	flag.StringVar(&flagGerritAuth, "gerrit-auth", "", "basic|digest|cookie")
+	flag.StringVar(&flagGerritUser, "gerrit-user", "", "")
+	flag.StringVar(&flagGerritPassword, "gerrit-password", "", "")
+	flag.StringVar(&flagGerritCookie, "gerrit-cookie", "", "name=value")
+	flag.StringVar(&flagGerritProject, "gerrit-project", "", "limit gerrit query to the project")
+	flag.StringVar(&flagGerritBranch, "gerrit-branch", "", "limit gerrit query to the branch")
+	flag.IntVar(&flagDownloadJobs, "jobs", 0, "number of concurrent downloads")
+	flag.BoolVar(&flagCacheClean, "cache-clean", false, "remove all cached debs")
+	flag.BoolVar(&flagPurge, "purge", false, "purge newly installed packages instead of removing them when restoring")
+	flag.BoolVar(&flagYes, "y", false, "assume yes, do not prompt")
+	flag.BoolVar(&flagYes, "yes", false, "same as -y")
+	flag.StringVar(&flagInclude, "include", "", "comma separated package name patterns, only install the matched packages")
+	flag.StringVar(&flagExclude, "exclude", "", "comma separated package name patterns, do not install the matched packages")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "download and simulate the install, do not change the system")
+	flag.BoolVar(&flagCheck, "check", false, "check test installed packages whose change is merged, abandoned or updated")
+	flag.StringVar(&flagArch, "arch", "", "comma separated architectures to install, default are the native and foreign architectures of dpkg")
+	flag.StringVar(&flagVersionPolicy, "version-policy", "", "version of the test packages, ci|installed|above, default installed")
+	flag.BoolVar(&flagJson, "json", false, "same as -format=json")
+	flag.StringVar(&flagFormat, "format", "", "output format of -status, text|table|json")
+	flag.StringVar(&flagRestore, "restore", "",
+		"all|$num|$repo#$num|$repo|$user|$change_url|$ci_url|$package_glob")
 }
 
 const (
 	organization = "linuxdeepin"
 
-	tempDebDownloadDir = "/tmp/pr-test/deb_download"
 	tempDebModifiedDir = "/tmp/pr-test/deb_modified"
 )
 
@@ -61,180 +99,40 @@ func getUrlBasename(u *url.URL) (string, error) {
 	return base, nil
 }
 
-func saveDeb(debUrl *url.URL, detail *jobDetail) (modifiedFilename string, err error) {
-	u := debUrl.String()
-	debug("download from", u)
-	resp, err := grequests.Get(u, nil)
-	if err != nil {
-		return
-	}
-
-	base, err := getUrlBasename(debUrl)
-	if err != nil {
-		return
-	}
-	filename := filepath.Join(tempDebDownloadDir, base)
-
-	err = os.MkdirAll(tempDebDownloadDir, 0755)
-	if err != nil {
-		return
-	}
-
-	err = resp.DownloadToFile(filename)
-	if err != nil {
-		return
-	}
-
-	modifiedFilename, err = modifyDeb(filename, &debDetail{
-		url:       u,
-		jobDetail: detail,
-	})
-	return
-}
-
-func modifyDeb(filename string, detail *debDetail) (modifiedFilename string, err error) {
-	modifiedFilename = filepath.Join(tempDebModifiedDir, filepath.Base(filename))
-	debug("modifiedFilename:", modifiedFilename)
-
-	err = os.MkdirAll(tempDebModifiedDir, 0755)
-	if err != nil {
-		return
-	}
-
-	err = sh.Command("cp", filename, modifiedFilename).Run()
+func modifyControl(data []byte, detail *debDetail) ([]byte, error) {
+	var binParagraph control.BinaryParagraph
+	err := control.Unmarshal(&binParagraph, bytes.NewReader(data))
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	tempDir, err := ioutil.TempDir("", "pr-test-mod")
+	pkgName, err := getPkgKey(binParagraph.Package, binParagraph.Values["Architecture"])
 	if err != nil {
-		return
+		return nil, err
 	}
-	debug("tempDir:", tempDir)
-	defer func() {
-		err := os.RemoveAll(tempDir)
+	oldVer := binParagraph.Values["Version"]
+	oldDepends := binParagraph.Values["Depends"]
+	versions := detail.jobDetail.versions
+	vc := versions[pkgName]
+	if vc == nil {
+		installedVer, candidateVer, err := getPkgDB().getPolicy(pkgName)
 		if err != nil {
 			log.Println("WARN:", err)
 		}
-	}()
-
-	arFiles, err := getArFiles(modifiedFilename)
-	if err != nil {
-		return
-	}
-
-	var controlTarFile string
-	var tarExt string
-	for _, file := range arFiles {
-		if strings.HasPrefix(file, "control.tar") {
-			controlTarFile = file
-			tarExt = filepath.Ext(file)
-		}
-	}
-
-	if controlTarFile == "" {
-		err = errors.New("not found control tar file in deb file")
-		return
-	}
-
-	session := sh.NewSession().SetDir(tempDir)
-	err = session.Command("ar", "x", modifiedFilename, controlTarFile).Run()
-	if err != nil {
-		return
-	}
-
-	const (
-		extGz = ".gz"
-		extXz = ".xz"
-	)
-	switch tarExt {
-	case extGz:
-		err = session.Command("gunzip", controlTarFile).Run()
-	case extXz:
-		err = session.Command("xz", "-d", controlTarFile).Run()
-	default:
-		err = fmt.Errorf("unknown control.tar ext %q", tarExt)
-	}
-	if err != nil {
-		return
-	}
-
-	err = session.Command("tar", "--extract", "--file=control.tar", "./control").Run()
-	if err != nil {
-		return
-	}
-
-	err = modifyControl(filepath.Join(tempDir, "control"), detail)
-	if err != nil {
-		return
-	}
-
-	// rebuild deb
-	err = session.Command("tar", "--update", "-f", "control.tar", "./control").Run()
-	if err != nil {
-		return
-	}
-
-	switch tarExt {
-	case extGz:
-		err = session.Command("gzip", "control.tar").Run()
-	case extXz:
-		err = session.Command("xz", "-z", "control.tar").Run()
-	}
-	if err != nil {
-		return
-	}
-
-	err = session.Command("ar", "r", modifiedFilename, controlTarFile).Run()
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-func replaceDependsVersion(d dependency.Dependency, oldVer, newVer string) string {
-	for _, r := range d.Relations {
-		for pIdx := range r.Possibilities {
-			ver := r.Possibilities[pIdx].Version
-			if ver != nil && ver.Number == oldVer {
-				r.Possibilities[pIdx].Version.Number = newVer
-			}
-		}
-	}
-	return d.String()
-}
-
-func modifyControl(filename string, detail *debDetail) error {
-	fh, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err := fh.Close()
-		if err != nil {
-			log.Println("WARN: failed to close file:", err)
-		}
-	}()
-	br := bufio.NewReader(fh)
-
-	var binParagraph control.BinaryParagraph
-	err = control.Unmarshal(&binParagraph, br)
-	if err != nil {
-		return err
-	}
-
-	pkgName := binParagraph.Package
-	oldVer := binParagraph.Values["Version"]
-	oldDepends := binParagraph.Values["Depends"]
-	newVer, err := getNewVersion(pkgName)
-	if err != nil {
-		log.Printf("WARN: failed to get new version for %s: %v\n", pkgName, err)
+		policy := pkgPolicy{installedVersion: installedVer, candidateVersion: candidateVer}
+		vc = newVersionChange(pkgName, oldVer, policy, detail.jobDetail.detail)
+		versions[pkgName] = vc
 	}
-	if newVer != "" {
+	newVer := vc.newVersion
+	if newVer != oldVer {
 		binParagraph.Set("Version", newVer)
-		binParagraph.Set("Depends", replaceDependsVersion(binParagraph.Depends, oldVer, newVer))
 	}
+	detail.pkgName = pkgName
+	detail.ciVersion = oldVer
+	detail.newVersion = newVer
+	detail.installedVersion = vc.installedVersion
+	detail.relationChanges = rewriteRelationVersions(&binParagraph, binParagraph.Values["Architecture"],
+		versions)
 
 	var descBuf bytes.Buffer
 	descBuf.WriteString(binParagraph.Description)
@@ -242,12 +140,14 @@ func modifyControl(filename string, detail *debDetail) error {
 	prDetail := detail.jobDetail.detail
 	parts := []string{
 		"DEPENDS", oldDepends,
+		"PR_BACKEND", prDetail.backend,
 		"PR_URL", prDetail.url,
-		//"PR_REPO", prDetail.repo,
-		//"PR_NUM", strconv.Itoa(prDetail.num),
+		"PR_REPO", prDetail.repo,
+		"PR_NUM", strconv.Itoa(prDetail.num),
 		"PR_USER", prDetail.user,
 		"PR_TITLE", prDetail.title,
 		"PR_STATE", prDetail.state,
+		"PR_REVISION", prDetail.revision,
 
 		"CI_URL", detail.jobDetail.url,
 
@@ -264,60 +164,20 @@ func modifyControl(filename string, detail *debDetail) error {
 	descBuf.WriteString("=end")
 	binParagraph.Set("Description", descBuf.String())
 
-	f, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = f.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}()
-
-	bw := bufio.NewWriter(f)
-	err = binParagraph.WriteTo(bw)
+	var buf bytes.Buffer
+	err = binParagraph.WriteTo(&buf)
 	if err != nil {
-		return err
-	}
-	err = bw.Flush()
-	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if flagVerbose {
 		err = binParagraph.WriteTo(os.Stdout)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
-}
-
-var globalClient *github.Client
-
-func getGithubClient() *github.Client {
-	if globalClient != nil {
-		return globalClient
-	}
-
-	token, err := getGithubAccessToken()
-	if err != nil {
-		log.Println("WARN: failed to get github access token:", err)
-	}
-
-	ctx := context.Background()
-	var httpClient *http.Client
-	if token != "" {
-		httpClient = oauth2.NewClient(ctx, oauth2.StaticTokenSource(
-			&oauth2.Token{
-				AccessToken: token,
-			}))
-	}
-	client := github.NewClient(httpClient)
-	globalClient = client
-	return client
+	return buf.Bytes(), nil
 }
 
 func main() {
@@ -337,9 +197,21 @@ func main() {
 			log.Fatal(err)
 		}
 		return
+	} else if flagCheck {
+		err := checkInstalled()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	} else if flagVersion {
 		fmt.Println(VERSION)
 		return
+	} else if flagCacheClean {
+		err := cleanCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	} else if flagUpgradeSelf {
 		err := upgradeSelf()
 		if err != nil {
@@ -348,259 +220,48 @@ func main() {
 		return
 	}
 
-	// TODO
-	//client := getGithubClient()
-	//var prIds []pullRequestId
-	//for _, arg := range flag.Args() {
-	//	ids, err := getPrIdsFromCmdArg(client, arg)
-	//	if err != nil {
-	//		log.Fatal(err)
-	//	}
-	//	prIds = append(prIds, ids...)
-	//}
-	//prIds = uniqPrIds(prIds)
-	//prIdsStrList := make([]string, len(prIds))
-	//for idx, id := range prIds {
-	//	prIdsStrList[idx] = id.String()
-	//}
-	//debug("found pull request:", strings.Join(prIdsStrList, ", "))
-	//for _, prId := range prIds {
-	//	err := installPullRequest(client, prId)
-	//	if err != nil {
-	//		log.Fatal(err)
-	//	}
-	//}
-
-	client, err := newGerritClient()
-	if err != nil {
-		log.Fatal(err)
-	}
 	args := flag.Args()
-	if len(args) != 1 {
-		log.Println("usage pr-test NUM")
+	if len(args) == 0 {
+		log.Println("usage: pr-test [options] PR_URL|REPO#NUM|@ISSUE_REPO#NUM|NUM|GERRIT_CHANGE_URL|GERRIT_QUERY ...")
 		os.Exit(1)
 	}
-	changeID := args[0]
-	jobUrl, detail, err := getJobUrlFromGerritChange(client, changeID)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = installJobDebs(jobUrl, detail)
+
+	changes, err := resolveChanges(args)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-func getPrIdsFromCmdArg(client *github.Client, arg string) ([]pullRequestId, error) {
-	issueShortReg := regexp.MustCompile(`^@([^#]+)#(\d+)$`)
-	// match @xxx#37
-	match := issueShortReg.FindStringSubmatch(arg)
-	if match != nil {
-		repo := match[1]
-		num, err := strconv.Atoi(match[2])
+	for _, c := range changes {
+		err = installChange(c)
 		if err != nil {
-			return nil, err
-		}
-		switch repo {
-		case "id":
-			repo = "internal-discussion"
-		case "dc":
-			repo = "developer-center"
+			log.Fatal(err)
 		}
-		arg1 := fmt.Sprintf("https://github.com/%s/%s/issues/%d", organization, repo, num)
-		arg = arg1
 	}
-
-	if strings.Contains(arg, "/issues/") {
-		return getPrIdsWithIssue(client, arg)
-	}
-	id, err := getPRIdFromCmdArg(arg)
-	if err != nil {
-		return nil, err
-	}
-	return []pullRequestId{id}, nil
 }
 
-var globalPRCache = make(map[pullRequestId]*github.PullRequest)
+var regHrefDeb1 = regexp.MustCompile(`href="(\S+\.deb)">`)
+var regHrefDeb2 = regexp.MustCompile(`\.href = '(\S+\.deb)'`)
 
-func getPullRequest(client *github.Client, repo string, num int) (*github.PullRequest, error) {
-	pr := globalPRCache[pullRequestId{repo: repo, num: num}]
-	if pr != nil {
-		return pr, nil
+func getDebArtifacts(cache *debCache, jobUrl string) ([]*debArtifact, error) {
+	artifacts := cache.getJobArtifacts(jobUrl)
+	if artifacts != nil {
+		debug("use cached artifacts of", jobUrl)
+		return artifacts, nil
 	}
 
-	ctx := context.Background()
-	pr, _, err := client.PullRequests.Get(ctx, organization, repo, num)
+	build, err := getJenkinsBuild(jobUrl)
 	if err != nil {
-		return nil, err
+		log.Println("WARN: failed to get build from jenkins api, try to parse the job page:", err)
+		return getDebArtifactsFromHtml(jobUrl)
 	}
-
-	globalPRCache[pullRequestId{repo: repo, num: num}] = pr
-	return pr, nil
-}
-
-func getPrIdsWithIssue(client *github.Client, issueUrl string) ([]pullRequestId, error) {
-	iId, err := parseIssueUrl(issueUrl)
+	artifacts, err = getJenkinsDebArtifacts(build)
 	if err != nil {
 		return nil, err
 	}
-
-	ctx := context.Background()
-	page := 1
-	var prIds []pullRequestId
-	for {
-		timeline, resp, err := client.Issues.ListIssueTimeline(ctx, iId.owner, iId.repo, iId.num, &github.ListOptions{
-			Page:    page,
-			PerPage: 100,
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		_ = timeline
-		//for _, timelineItem := range timeline {
-		//	if timelineItem.GetEvent() == "cross-referenced" {
-		//		src := timelineItem.GetSource()
-		//		if src.GetIssue() != nil &&
-		//			src.GetIssue().IsPullRequest() {
-		//			prLinks := src.GetIssue().GetPullRequestLinks()
-		//			prId, err := parsePullUrl(prLinks.GetHTMLURL())
-		//			if err != nil {
-		//				continue
-		//			}
-		//
-		//			pr, err := getPullRequest(client, prId.repo, prId.num)
-		//			if err != nil {
-		//				return nil, err
-		//			}
-		//			if pr.GetState() == "closed" && !pr.GetMerged() {
-		//				debug("ignore abandoned:", prId.String())
-		//				continue
-		//			}
-		//			prIds = append(prIds, prId)
-		//		}
-		//	}
-		//}
-
-		if resp.NextPage == 0 {
-			break
-		}
-		page = resp.NextPage
-	}
-	return prIds, nil
+	cache.setJobArtifacts(jobUrl, artifacts)
+	return artifacts, nil
 }
 
-type pullRequestId struct {
-	repo string
-	num  int
-}
-
-func (prId pullRequestId) String() string {
-	return fmt.Sprintf("%s#%d", prId.repo, prId.num)
-}
-
-func uniqPrIds(ids []pullRequestId) (result []pullRequestId) {
-	repoNumsMap := make(map[string][]int)
-	for _, id := range ids {
-		repoNumsMap[id.repo] = append(repoNumsMap[id.repo], id.num)
-	}
-
-	for repo, nums := range repoNumsMap {
-		sort.Ints(nums)
-		num := nums[len(nums)-1]
-		result = append(result, pullRequestId{repo: repo, num: num})
-	}
-	return
-}
-
-func getPRIdFromCmdArg(arg string) (pullRequestId, error) {
-	num, err := strconv.Atoi(arg)
-	if err == nil {
-		repo, err := getRepoFromGitConfig()
-		if err != nil {
-			return pullRequestId{}, err
-		}
-		return pullRequestId{repo: repo, num: num}, nil
-	}
-	reg := regexp.MustCompile(`^(\S+)#(\d+)$`)
-	match := reg.FindStringSubmatch(arg)
-	if match != nil {
-		repo := match[1]
-		num, err := strconv.Atoi(match[2])
-		if err != nil {
-			return pullRequestId{}, err
-		}
-		return pullRequestId{repo: repo, num: num}, nil
-	}
-
-	return parsePullUrl(arg)
-}
-
-func getRepoFromGitConfig() (string, error) {
-	out, err := sh.Command("git", "config", "--local",
-		"--get-regexp", `remote\..*\.url`).Output()
-	if err != nil {
-		return "", err
-	}
-	remotes := bytes.Split(out, []byte("\n"))
-	reg := regexp.MustCompile(fmt.Sprintf(`github.com[:/]%s/(.+)$`, organization))
-	for _, remote := range remotes {
-		match := reg.FindSubmatch(remote)
-		if match != nil {
-			repo := string(match[1])
-			repo = strings.TrimSuffix(repo, ".git")
-			return repo, nil
-		}
-	}
-	return "", errors.New("repo not found in remote urls")
-}
-
-func getSuccessStatus(statuses []*github.RepoStatus) *github.RepoStatus {
-	for _, status := range statuses {
-		if status.GetState() == "success" {
-			return status
-		}
-	}
-	return nil
-}
-
-func parsePullUrl(pullUrl string) (prId pullRequestId, err error) {
-	reg := regexp.MustCompile("https://github.com/" + organization + `/([^/]+)/pull/(\d+)`)
-	match := reg.FindStringSubmatch(pullUrl)
-	if match == nil {
-		err = errors.New("invalid pull url")
-		return
-	}
-
-	prId.repo = match[1]
-	prId.num, err = strconv.Atoi(match[2])
-	return
-}
-
-type issueId struct {
-	owner string
-	repo  string
-	num   int
-}
-
-func parseIssueUrl(issueUrl string) (iId issueId, err error) {
-	reg := regexp.MustCompile(`https://github.com/([^/]+)/([^/]+)/issues/(\d+)`)
-	match := reg.FindStringSubmatch(issueUrl)
-	if match == nil {
-		err = errors.New("invalid issue url")
-		return
-	}
-
-	iId.owner = match[1]
-	iId.repo = match[2]
-	iId.num, err = strconv.Atoi(match[3])
-	return
-}
-
-var regHrefDeb1 = regexp.MustCompile(`href="(\S+\.deb)">`)
-var regHrefDeb2 = regexp.MustCompile(`\.href = '(\S+\.deb)'`)
-
-func getDebUrls(jobUrl string) ([]*url.URL, error) {
+func getDebArtifactsFromHtml(jobUrl string) ([]*debArtifact, error) {
 	resp, err := grequests.Get(jobUrl, nil)
 	if err != nil {
 		return nil, err
@@ -621,13 +282,13 @@ func getDebUrls(jobUrl string) ([]*url.URL, error) {
 		return nil, nil
 	}
 
-	var result = make([]*url.URL, len(allMatch))
+	var result = make([]*debArtifact, len(allMatch))
 	for idx, match := range allMatch {
 		u, err := url.Parse(jobUrl + match[1])
 		if err != nil {
 			return nil, err
 		}
-		result[idx] = u
+		result[idx] = &debArtifact{url: u}
 	}
 	return result, nil
 }
@@ -669,120 +330,76 @@ func parseDebFilename(filename string) (pkgName, version, arch string, err error
 	return
 }
 
-func showPullRequestInfo(prId pullRequestId, pr *github.PullRequest) {
-	fmt.Printf("> %s #%d\n", prId.repo, prId.num)
-	fmt.Println("title:", pr.GetTitle())
-	fmt.Println("state:", pr.GetState())
-	fmt.Println("merged:", pr.GetMerged())
-	fmt.Println("user:", pr.GetUser().GetLogin())
+type debArtifact struct {
+	url *url.URL
+	// 校验和，jenkins 没有提供时为空
+	md5    string
+	sha256 string
 }
 
 type debDetail struct {
 	url       string
 	jobDetail *jobDetail
+
+	// 以下字段在修改 control 文件时设置
+	pkgName          string
+	ciVersion        string
+	newVersion       string
+	installedVersion string
+	relationChanges  []fieldChange
 }
 
 type jobDetail struct {
 	url    string
 	detail *patchDetail
+	// job 中要安装的包的版本变化，key 同 jobPackage.key
+	versions map[string]*versionChange
 }
 
-type pullRequestDetail struct {
-	pullRequestId
-	url   string
+type patchDetail struct {
+	// 来源，github 或 gerrit
+	backend string
+	id      string
+	url     string
+	// github 上是仓库名，gerrit 上是 project
+	repo  string
+	num   int
 	user  string
 	title string
 	state string
+	// gerrit 上是 patch set 的编号，github 上是 head 的 commit id
+	revision string
 }
 
-func installPullRequest(client *github.Client, prId pullRequestId) error {
-	ctx := context.Background()
-	pr, err := getPullRequest(client, prId.repo, prId.num)
+func installJobDebs(jobUrl string, detail *patchDetail) error {
+	if !flagDryRun {
+		err := recoverInstallJournal()
+		if err != nil {
+			return err
+		}
+	}
+	cache, err := openDebCache()
 	if err != nil {
 		return err
 	}
-
-	showPullRequestInfo(prId, pr)
-
-	prRef := pr.GetHead().GetSHA()
-	if prRef == "" {
-		return errors.New("failed to get pull request ref")
-	}
-	statuses, _, err := client.Repositories.ListStatuses(ctx, organization, prId.repo,
-		prRef, nil)
+	artifacts, err := getDebArtifacts(cache, jobUrl)
 	if err != nil {
 		return err
 	}
-
-	status := getSuccessStatus(statuses)
-	if status == nil {
-		var targetUrl0 string
-		for _, status := range statuses {
-			targetUrl := status.GetTargetURL()
-			if targetUrl != "" {
-				targetUrl0 = targetUrl
-			}
-			break
-		}
-
-		errMsg := "not found success status"
-		if targetUrl0 != "" {
-			errMsg += ", please see " + targetUrl0
-		}
-		return errors.New(errMsg)
-	}
-
-	targetUrl := status.GetTargetURL()
-	if targetUrl == "" {
-		return errors.New("target url is empty")
-	}
-
-	debug("targetUrl:", targetUrl)
-
-	detail := &patchDetail{
-		id:    strconv.Itoa(int(pr.GetID())),
-		url:   pr.GetHTMLURL(),
-		user:  pr.GetUser().GetLogin(),
-		title: pr.GetTitle(),
-		state: pr.GetState(),
-	}
-	jobUrl := strings.TrimSuffix(targetUrl, "/console")
-	err = installJobDebs(jobUrl, detail)
-	return err
-}
-
-func needDefaultInstall(pkgName string) bool {
-	if strings.HasSuffix(pkgName, "-dev") ||
-		strings.HasSuffix(pkgName, "-dbg") ||
-		strings.HasSuffix(pkgName, "-dbgsym") {
-		return false
-	}
-
-	switch pkgName {
-	case "libdtkwidget-bin":
-		return false
+	if flagDryRun {
+		showArtifacts(jobUrl, artifacts)
 	}
 
-	return true
-}
-
-type patchDetail struct {
-	id    string
-	url   string
-	user  string
-	title string
-	state string
-}
-
-func installJobDebs(jobUrl string, detail *patchDetail) error {
-	debUrls, err := getDebUrls(jobUrl)
+	archs, err := getInstallArchs()
 	if err != nil {
 		return err
 	}
-
-	pkgUrlMap := make(map[string]*url.URL)
-	for _, debUrl := range debUrls {
-		base, err := getUrlBasename(debUrl)
+	var skipped []string
+	var pkgs []*jobPackage
+	// 同一个包可能在产物中出现多次，只保留第一个，否则会并发下载到同一个文件
+	pkgKeys := make(map[string]bool)
+	for _, artifact := range artifacts {
+		base, err := getUrlBasename(artifact.url)
 		if err != nil {
 			return err
 		}
@@ -791,42 +408,77 @@ func installJobDebs(jobUrl string, detail *patchDetail) error {
 		if err != nil {
 			return err
 		}
-		hostArch, err := getDpkgArch()
+		if arch != archAll && !strSliceContains(archs, arch) {
+			skipped = append(skipped, base)
+			continue
+		}
+		pkgKey, err := getPkgKey(pkgName, arch)
 		if err != nil {
 			return err
 		}
-		if hostArch != arch {
+		if pkgKeys[pkgKey] {
+			log.Println("WARN: ignore duplicate artifact", artifact.url)
 			continue
 		}
+		pkgKeys[pkgKey] = true
+		pkgs = append(pkgs, &jobPackage{
+			key:      pkgKey,
+			name:     pkgName,
+			arch:     arch,
+			artifact: artifact,
+		})
+	}
+	showSkippedArtifacts(skipped, archs)
+	loadJobPackageControls(cache, jobUrl, pkgs)
 
-		defaultYes := needDefaultInstall(pkgName)
-		respYes, err := askYesNo(fmt.Sprintf("install %s?", pkgName), defaultYes)
+	selected := make(map[string]bool)
+	for _, pkg := range pkgs {
+		respYes, err := askInstallPackage(pkg.key)
 		if err != nil {
 			return err
 		}
-
 		if respYes {
-			pkgUrlMap[pkgName] = debUrl
+			selected[pkg.key] = true
 		}
 	}
+	includeRequiredSiblings(pkgs, selected)
 
-	if len(pkgUrlMap) == 0 {
+	var selectedArtifacts []*debArtifact
+	for _, pkg := range pkgs {
+		if selected[pkg.key] {
+			selectedArtifacts = append(selectedArtifacts, pkg.artifact)
+		}
+	}
+	if len(selectedArtifacts) == 0 {
 		return nil
 	}
+	downloadedFiles, err := cache.fetchDebs(jobUrl, selectedArtifacts)
+	if err != nil {
+		return err
+	}
 
+	jobDetail := &jobDetail{
+		url:      jobUrl,
+		detail:   detail,
+		versions: getJobVersionChanges(pkgs, detail),
+	}
 	var files []string
-	for _, debUrl := range pkgUrlMap {
-		jobDetail := &jobDetail{
-			url: jobUrl,
-			//prDetail: prDetail,
-			detail: detail,
+	var debDetails []*debDetail
+	for idx, artifact := range selectedArtifacts {
+		debDetail := &debDetail{
+			url:       artifact.url.String(),
+			jobDetail: jobDetail,
 		}
-		var filename string
-		filename, err = saveDeb(debUrl, jobDetail)
+		filename, err := modifyDeb(downloadedFiles[idx], debDetail)
 		if err != nil {
 			return err
 		}
 		files = append(files, filename)
+		debDetails = append(debDetails, debDetail)
+	}
+
+	if flagDryRun {
+		return dryRunInstall(debDetails, files)
 	}
 
 	// simulate
@@ -840,176 +492,52 @@ func installJobDebs(jobUrl string, detail *patchDetail) error {
 		return err
 	}
 
-	replyYes, err := askYesNo("Do you want to continue?", true)
-	if err != nil {
-		return err
-	}
-	if !replyYes {
-		return nil
-	}
-
-	for pkgName := range pkgUrlMap {
-		err = markInstall(pkgName)
+	if !flagYes {
+		replyYes, err := askYesNo("Do you want to continue?", true)
 		if err != nil {
 			return err
 		}
-	}
-
-	cmdArgs = append(commonCmdArgs, files...)
-	err = sh.Command("sudo", cmdArgs).Run()
-	return err
-}
-
-func showStatus() error {
-	all, _, err := getAllPkgInstallDetails()
-	if err != nil {
-		return err
-	}
-
-	for _, detail := range all {
-		fmt.Println("Repo:", detail["PR_REPO"])
-		fmt.Println("Package:", detail["pkgs"])
-		fmt.Println("Title:", detail["PR_TITLE"])
-		fmt.Println("User:", detail["PR_USER"])
-		fmt.Println("PR url:", detail["PR_URL"])
-		fmt.Println("Job url:", detail["CI_URL"], "\n")
-	}
-	return nil
-}
-
-func getAllPkgInstallDetails() (allDetails map[string]map[string]string, invalidList []string, err error) {
-	fileInfos, err := ioutil.ReadDir(markDir)
-	if err != nil {
-		return
-	}
-	allDetails = make(map[string]map[string]string)
-	for _, fileInfo := range fileInfos {
-		pkg := fileInfo.Name()
-		var detail map[string]string
-		detail, err = getPkgInstallDetail(pkg)
-		if err != nil {
-			log.Println("WARN:", err)
-			err = nil
-		}
-		if len(detail) == 0 {
-			debugF("patchDetail about %s is empty\n", pkg)
-			invalidList = append(invalidList, pkg)
-			continue
-		}
-
-		key := detail["CI_URL"]
-		if key == "" {
-			continue
-		}
-		v, ok := allDetails[key]
-		if ok {
-			v["pkgs"] = v["pkgs"] + " " + pkg
-		} else {
-			detail["pkgs"] = pkg
-			allDetails[key] = detail
+		if !replyYes {
+			return nil
 		}
 	}
-	return
+
+	return installDebsTransaction(jobUrl, debDetails, files, commonCmdArgs)
 }
 
 func getPkgInstallDetail(pkg string) (detail map[string]string, err error) {
-	out, err := sh.Command("dpkg-query", "-f", `${db:Status-Status}\n${Description}\n`, "--show", pkg).CombinedOutput()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if exitErr.ExitCode() == 1 {
-				err = nil
-				return
-			}
-		}
-		return
-	}
-
-	lines := bytes.Split(out, []byte{'\n'})
-	status := string(lines[0])
-	if status != "installed" {
+	info, err := getPkgDB().getInstalled(pkg)
+	if err != nil || info == nil || info.status != "installed" {
 		return
 	}
 
 	var begin bool
 	detail = make(map[string]string, 9)
-	for _, line := range lines {
-		line = bytes.TrimSpace(line)
+	for _, line := range strings.Split(info.description, "\n") {
+		line = strings.TrimSpace(line)
 		if !begin {
-			if bytes.Equal(line, []byte("=begin")) {
+			if line == "=begin" {
 				begin = true
 			}
 			continue
 		} else {
-			if bytes.Equal(line, []byte("=end")) {
+			if line == "=end" {
 				break
 			}
 
-			fields := bytes.SplitN(line, []byte{'='}, 2)
+			fields := strings.SplitN(line, "=", 2)
 			if len(fields) != 2 {
 				continue
 			}
 
-			key := string(fields[0])
-			value := string(fields[1])
+			key := fields[0]
+			value := fields[1]
 			detail[key] = value
 		}
 	}
 	return
 }
 
-func restore(pattern string) error {
-	allDetail, invalidList, err := getAllPkgInstallDetails()
-	if err != nil {
-		return err
-	}
-
-	var pkgList []string
-	for _, detail := range allDetail {
-		if pattern == "all" ||
-			detail["PR_REPO"] == pattern ||
-			detail["PR_USER"] == pattern {
-
-			pkgListTemp := strings.Fields(detail["pkgs"])
-			pkgList = append(pkgList, pkgListTemp...)
-		}
-	}
-	debug("pkgList:", pkgList)
-	debug("invalidList:", invalidList)
-
-	if len(pkgList) == 0 && len(invalidList) == 0 {
-		return nil
-	}
-
-	if len(pkgList) > 0 {
-		fmt.Println("restore", pkgList)
-
-		cmdArgs := []string{"apt-get", "install", "--fix-missing", "-y", "--reinstall"}
-		cmdArgs = append(cmdArgs, pkgList...)
-		err = sh.Command("sudo", cmdArgs).Run()
-		if err != nil {
-			return err
-		}
-	}
-
-	for _, pkg := range append(pkgList, invalidList...) {
-		detail, err := getPkgInstallDetail(pkg)
-		if err != nil {
-			log.Println("WARN:", err)
-		}
-
-		if len(detail) == 0 {
-			// restore success
-			err = markUninstall(pkg)
-			if err != nil {
-				return err
-			}
-		} else {
-			log.Println("WARN: failed to restore", pkg)
-		}
-	}
-	return err
-}
-
 func upgradeSelf() error {
 	const (
 		owner = "electricface"
@@ -1060,35 +588,3 @@ func upgradeSelf() error {
 	err = session.Command(scriptFilename).Run()
 	return err
 }
-
-func getNewVersion(pkgName string) (string, error) {
-	out, err := sh.Command("env", "LC_ALL=C", "apt-cache", "policy", pkgName).Output()
-	if err != nil {
-		return "", err
-	}
-	/*
-		输出类似于
-
-		bash:
-		  Installed: 4.4.18-2+b1
-		  Candidate: 4.4.18-2+b1
-	*/
-	lines := bytes.Split(out, []byte{'\n'})
-
-	getVal := func(line []byte) string {
-		fields := bytes.Fields(bytes.TrimSpace(line))
-		if len(fields) < 2 {
-			return ""
-		}
-		return string(fields[1])
-	}
-
-	installedVer := getVal(lines[1])
-	candidateVer := getVal(lines[2])
-
-	if candidateVer != "" && installedVer == "(none)" {
-		return candidateVer, nil
-	}
-
-	return installedVer, nil
-}
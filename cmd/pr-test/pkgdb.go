@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sh "github.com/codeskyblue/go-sh"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/version"
+)
+
+// pkgDB 直接读取 dpkg 的 status 文件和 apt 的 Packages 文件，查询包的已安装版本和软件源中的所有版本，
+// 不用为每个包运行 dpkg-query。
+// 候选版本不从 Packages 文件计算：apt 按 /etc/apt/preferences 中的 pin 和各个源的优先级
+// （比如 NotAutomatic 的源、target release）选择候选版本，不一定是最高的版本，
+// 自己实现这些规则容易和 apt 不一致，所以仍然由 apt-cache policy 给出，多个包一次查询。
+
+const (
+	dpkgStatusFile = "/var/lib/dpkg/status"
+	aptListsDir    = "/var/lib/apt/lists"
+)
+
+type pkgDB struct {
+	statusFile string
+	listsDir   string
+
+	// key 同 getPkgKey 的返回值，外部架构的包带有 :arch 后缀
+	installed      map[string]*installedPkg
+	statusModTime  time.Time
+	available      map[string][]string
+	availableReady bool
+
+	// 查询候选版本，返回的 map 的 key 同 installed
+	candidateFn func(pkgs []string) (map[string]string, error)
+}
+
+type installedPkg struct {
+	name    string
+	arch    string
+	version string
+	// Status 字段的最后一项，比如 installed，config-files
+	status      string
+	description string
+}
+
+func newPkgDB(statusFile, listsDir string) *pkgDB {
+	return &pkgDB{
+		statusFile:  statusFile,
+		listsDir:    listsDir,
+		candidateFn: getAptCandidates,
+	}
+}
+
+var globalPkgDB *pkgDB
+
+func getPkgDB() *pkgDB {
+	if globalPkgDB == nil {
+		globalPkgDB = newPkgDB(dpkgStatusFile, aptListsDir)
+	}
+	return globalPkgDB
+}
+
+func readParagraphs(r io.Reader, fn func(p *control.Paragraph) error) error {
+	pr, err := control.NewParagraphReader(r, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		p, err := pr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = fn(p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loadStatus 读取 status 文件，文件没有变化时不重新读取，安装或删除包后调用即可得到最新的状态。
+func (db *pkgDB) loadStatus() error {
+	fileInfo, err := os.Stat(db.statusFile)
+	if err != nil {
+		return err
+	}
+	if db.installed != nil && fileInfo.ModTime().Equal(db.statusModTime) {
+		return nil
+	}
+
+	f, err := os.Open(db.statusFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := f.Close()
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+
+	installed := make(map[string]*installedPkg)
+	err = readParagraphs(f, func(p *control.Paragraph) error {
+		statusFields := strings.Fields(p.Values["Status"])
+		if len(statusFields) == 0 {
+			return nil
+		}
+		pkg := &installedPkg{
+			name:        p.Values["Package"],
+			arch:        p.Values["Architecture"],
+			version:     p.Values["Version"],
+			status:      statusFields[len(statusFields)-1],
+			description: p.Values["Description"],
+		}
+		key, err := getPkgKey(pkg.name, pkg.arch)
+		if err != nil {
+			return err
+		}
+		installed[key] = pkg
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.installed = installed
+	db.statusModTime = fileInfo.ModTime()
+	return nil
+}
+
+func openPackagesFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	switch filepath.Ext(filename) {
+	case ".gz":
+		r, err = gzip.NewReader(f)
+	case ".xz":
+		r, err = xz.NewReader(f)
+	case ".lz4":
+		r = lz4.NewReader(f)
+	default:
+		return f, nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// getPackagesFiles 返回 apt lists 目录中的 Packages 文件，同一个文件有多种压缩格式时只取一个。
+func (db *pkgDB) getPackagesFiles() ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(db.listsDir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	seen := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		base := name
+		switch ext := filepath.Ext(name); ext {
+		case ".gz", ".xz", ".lz4":
+			base = strings.TrimSuffix(name, ext)
+		}
+		if !strings.HasSuffix(base, "_Packages") || seen[base] {
+			continue
+		}
+		seen[base] = true
+		result = append(result, filepath.Join(db.listsDir, name))
+	}
+	return result, nil
+}
+
+func (db *pkgDB) loadAvailable() error {
+	if db.availableReady {
+		return nil
+	}
+	files, err := db.getPackagesFiles()
+	if err != nil {
+		return err
+	}
+
+	available := make(map[string][]string)
+	for _, filename := range files {
+		debug("read packages file:", filename)
+		r, err := openPackagesFile(filename)
+		if err != nil {
+			log.Println("WARN:", err)
+			continue
+		}
+		err = readParagraphs(r, func(p *control.Paragraph) error {
+			key, err := getPkgKey(p.Values["Package"], p.Values["Architecture"])
+			if err != nil {
+				return err
+			}
+			ver := p.Values["Version"]
+			if !strSliceContains(available[key], ver) {
+				available[key] = append(available[key], ver)
+			}
+			return nil
+		})
+		closeErr := r.Close()
+		if closeErr != nil {
+			log.Println("WARN:", closeErr)
+		}
+		if err != nil {
+			log.Printf("WARN: failed to read %s: %v\n", filename, err)
+		}
+	}
+	db.available = available
+	db.availableReady = true
+	return nil
+}
+
+// normalizePkgKey 把本机架构和 all 的 pkg:arch 转为 pkg。
+func normalizePkgKey(pkg string) (string, error) {
+	fields := strings.SplitN(pkg, ":", 2)
+	if len(fields) != 2 {
+		return pkg, nil
+	}
+	return getPkgKey(fields[0], fields[1])
+}
+
+// getInstalled 返回包的安装信息，dpkg 中没有记录时返回 nil。
+func (db *pkgDB) getInstalled(pkg string) (*installedPkg, error) {
+	err := db.loadStatus()
+	if err != nil {
+		return nil, err
+	}
+	key, err := normalizePkgKey(pkg)
+	if err != nil {
+		return nil, err
+	}
+	return db.installed[key], nil
+}
+
+// getInstalledVersion 返回已安装的版本，没有安装时为空。
+func (db *pkgDB) getInstalledVersion(pkg string) (string, error) {
+	info, err := db.getInstalled(pkg)
+	if err != nil || info == nil || info.status != "installed" {
+		return "", err
+	}
+	return info.version, nil
+}
+
+// getAvailableVersions 返回软件源中包的所有版本，从高到低排列。
+func (db *pkgDB) getAvailableVersions(pkg string) ([]string, error) {
+	err := db.loadAvailable()
+	if err != nil {
+		return nil, err
+	}
+	key, err := normalizePkgKey(pkg)
+	if err != nil {
+		return nil, err
+	}
+	versions := append([]string(nil), db.available[key]...)
+	sortVersionsDesc(versions)
+	return versions, nil
+}
+
+func sortVersionsDesc(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		v1, err1 := version.Parse(versions[i])
+		v2, err2 := version.Parse(versions[j])
+		if err1 != nil || err2 != nil {
+			return versions[i] > versions[j]
+		}
+		return version.Compare(v1, v2) > 0
+	})
+}
+
+// getAptCandidates 运行 apt-cache policy 查询包的候选版本。
+func getAptCandidates(pkgs []string) (map[string]string, error) {
+	if len(pkgs) == 0 {
+		return map[string]string{}, nil
+	}
+	args := append([]string{"LC_ALL=C", "apt-cache", "policy"}, pkgs...)
+	out, err := sh.Command("env", args).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseAptCachePolicy(out)
+}
+
+// parseAptCachePolicy 解析 apt-cache policy 的输出，返回包的候选版本。
+func parseAptCachePolicy(out []byte) (map[string]string, error) {
+	/*
+		输出类似于
+
+		bash:
+		  Installed: 4.4.18-2+b1
+		  Candidate: 4.4.18-2+b1
+		  Version table:
+		libc6:i386:
+		  Installed: (none)
+		  Candidate: 2.28-10
+	*/
+	// 不存在的包，没有输出
+	result := make(map[string]string)
+	var key string
+	for _, line := range bytes.Split(out, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			if !bytes.HasSuffix(line, []byte{':'}) {
+				continue
+			}
+			var err error
+			key, err = normalizePkgKey(string(bytes.TrimSuffix(line, []byte{':'})))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fields := bytes.Fields(line)
+		if key == "" || len(fields) != 2 || string(fields[0]) != "Candidate:" {
+			continue
+		}
+		val := string(fields[1])
+		if val == "(none)" {
+			val = ""
+		}
+		result[key] = val
+	}
+	return result, nil
+}
+
+// getPolicy 返回已安装的版本和候选版本，查询候选版本失败时仍然返回已安装的版本。
+func (db *pkgDB) getPolicy(pkg string) (installedVer, candidateVer string, err error) {
+	policies, err := db.getPolicies([]string{pkg})
+	policy := policies[pkg]
+	return policy.installedVersion, policy.candidateVersion, err
+}
+
+type pkgPolicy struct {
+	installedVersion string
+	candidateVersion string
+}
+
+// getPolicies 一次查询多个包的版本，已安装的版本来自 status 文件，候选版本来自 apt。
+// 查询候选版本失败时，返回的结果中仍然有已安装的版本，同时返回错误。
+func (db *pkgDB) getPolicies(pkgs []string) (map[string]pkgPolicy, error) {
+	candidates, candidateErr := db.candidateFn(pkgs)
+	if candidateErr != nil {
+		candidateErr = fmt.Errorf("failed to get candidate versions: %v", candidateErr)
+	}
+	result := make(map[string]pkgPolicy, len(pkgs))
+	for _, pkg := range pkgs {
+		installedVer, err := db.getInstalledVersion(pkg)
+		if err != nil {
+			return nil, err
+		}
+		key, err := normalizePkgKey(pkg)
+		if err != nil {
+			return nil, err
+		}
+		result[pkg] = pkgPolicy{
+			installedVersion: installedVer,
+			candidateVersion: candidates[key],
+		}
+	}
+	return result, candidateErr
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+const testPkgDBDir = "testdata/pkgdb"
+
+// writeTestPackagesFile 把 testdata 中的 Packages 文件按 filename 的扩展名压缩后写入 dir。
+func writeTestPackagesFile(t *testing.T, dir, src, filename string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(testPkgDBDir, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.WriteCloser
+	switch filepath.Ext(filename) {
+	case ".gz":
+		w = gzip.NewWriter(f)
+	case ".xz":
+		w, err = xz.NewWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ".lz4":
+		w = lz4.NewWriter(f)
+	default:
+		_, err = f.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestPkgDB(t *testing.T) *pkgDB {
+	t.Helper()
+	_dpkgArchCache = "amd64"
+	listsDir := t.TempDir()
+	const prefix = "packages.deepin.com_deepin_dists_"
+	writeTestPackagesFile(t, listsDir, "main_Packages", prefix+"apricot_main_binary-amd64_Packages.gz")
+	writeTestPackagesFile(t, listsDir, "updates_Packages", prefix+"apricot-updates_main_binary-amd64_Packages.xz")
+	writeTestPackagesFile(t, listsDir, "security_Packages", prefix+"apricot-security_main_binary-i386_Packages.lz4")
+	err := ioutil.WriteFile(filepath.Join(listsDir, prefix+"apricot_InRelease"), []byte("Origin: Deepin\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := newPkgDB(filepath.Join(testPkgDBDir, "status"), listsDir)
+	db.candidateFn = func(pkgs []string) (map[string]string, error) {
+		out, err := ioutil.ReadFile(filepath.Join(testPkgDBDir, "policy.txt"))
+		if err != nil {
+			return nil, err
+		}
+		return parseAptCachePolicy(out)
+	}
+	return db
+}
+
+func TestPkgDBInstalled(t *testing.T) {
+	db := newTestPkgDB(t)
+
+	tests := []struct {
+		pkg     string
+		version string
+		status  string
+	}{
+		{"libdtkcore5", "5.2.2.3-1", "installed"},
+		{"libdtkcore5:amd64", "5.2.2.3-1", "installed"},
+		{"libdtkcore5:i386", "5.2.2.1-1", "installed"},
+		{"deepin-desktop-base", "2020.11.02-1", "installed"},
+		{"deepin-desktop-base:all", "2020.11.02-1", "installed"},
+		{"dde-daemon", "", "half-installed"},
+		{"dde-dock", "", "config-files"},
+		{"dde-control-center", "", ""},
+	}
+	for _, tt := range tests {
+		info, err := db.getInstalled(tt.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status string
+		if info != nil {
+			status = info.status
+		}
+		if status != tt.status {
+			t.Errorf("%s status = %q, want %q", tt.pkg, status, tt.status)
+		}
+
+		ver, err := db.getInstalledVersion(tt.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ver != tt.version {
+			t.Errorf("%s installed version = %q, want %q", tt.pkg, ver, tt.version)
+		}
+	}
+}
+
+func TestPkgInstallDetail(t *testing.T) {
+	oldDB := globalPkgDB
+	globalPkgDB = newTestPkgDB(t)
+	defer func() {
+		globalPkgDB = oldDB
+	}()
+
+	detail, err := getPkgInstallDetail("libdtkcore5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DEPENDS":    "libdtkcore5-bin (= 5.2.2.3-1), libc6 (>= 2.14)",
+		"PR_BACKEND": "github",
+		"PR_URL":     "https://github.com/linuxdeepin/dtkcore/pull/123",
+		"PR_NUM":     "123",
+		"CI_URL":     "https://ci.deepin.io/job/dtkcore/16/",
+	}
+	if !reflect.DeepEqual(detail, want) {
+		t.Errorf("detail = %v, want %v", detail, want)
+	}
+	if getTestInstalledCIUrl("libdtkcore5") != want["CI_URL"] {
+		t.Error("libdtkcore5 should be installed by", want["CI_URL"])
+	}
+
+	for _, pkg := range []string{"libdtkcore5:i386", "dde-daemon", "dde-dock", "dde-control-center"} {
+		if isTestInstalled(pkg) {
+			t.Errorf("%s should not be test installed", pkg)
+		}
+	}
+}
+
+func TestPkgDBAvailableVersions(t *testing.T) {
+	db := newTestPkgDB(t)
+
+	tests := []struct {
+		pkg  string
+		want []string
+	}{
+		{"libdtkcore5", []string{"5.2.2.10-1", "5.2.2.3-1"}},
+		{"libdtkcore5:i386", []string{"5.2.2.1-1+deb10u1", "5.2.2.1-1"}},
+		{"dde-daemon", []string{"5.12.0.20-1", "5.12.0.18-1"}},
+		{"deepin-desktop-base", []string{"2020.11.02-1"}},
+		{"dde-dock", nil},
+	}
+	for _, tt := range tests {
+		versions, err := db.getAvailableVersions(tt.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(versions, tt.want) {
+			t.Errorf("%s versions = %v, want %v", tt.pkg, versions, tt.want)
+		}
+	}
+}
+
+func TestPkgDBPolicies(t *testing.T) {
+	db := newTestPkgDB(t)
+
+	pkgs := []string{"libdtkcore5", "libdtkcore5:i386", "dde-dock", "dde-control-center"}
+	policies, err := db.getPolicies(pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]pkgPolicy{
+		// 软件源中有更高的版本，但是被 apt 的优先级设置固定在 5.2.2.3-1
+		"libdtkcore5":        {installedVersion: "5.2.2.3-1", candidateVersion: "5.2.2.3-1"},
+		"libdtkcore5:i386":   {installedVersion: "5.2.2.1-1", candidateVersion: "5.2.2.1-1+deb10u1"},
+		"dde-dock":           {},
+		"dde-control-center": {},
+	}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("policies = %+v, want %+v", policies, want)
+	}
+
+	installedVer, candidateVer, err := db.getPolicy("libdtkcore5:i386")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installedVer != "5.2.2.1-1" || candidateVer != "5.2.2.1-1+deb10u1" {
+		t.Errorf("getPolicy = %q, %q", installedVer, candidateVer)
+	}
+}
+
+func TestPkgDBPoliciesCandidateError(t *testing.T) {
+	db := newTestPkgDB(t)
+	db.candidateFn = func(pkgs []string) (map[string]string, error) {
+		return nil, errors.New("apt-cache failed")
+	}
+
+	installedVer, candidateVer, err := db.getPolicy("libdtkcore5")
+	if err == nil {
+		t.Error("expect error")
+	}
+	// 已安装的版本来自 status 文件，不受影响
+	if installedVer != "5.2.2.3-1" || candidateVer != "" {
+		t.Errorf("getPolicy = %q, %q", installedVer, candidateVer)
+	}
+}
+
+func TestGetOriginalState(t *testing.T) {
+	oldDB := globalPkgDB
+	globalPkgDB = newTestPkgDB(t)
+	defer func() {
+		globalPkgDB = oldDB
+	}()
+
+	tests := []struct {
+		pkg            string
+		version        string
+		newlyInstalled bool
+	}{
+		{"libdtkcore5", "5.2.2.3-1", false},
+		{"libdtkcore5:i386", "5.2.2.1-1", false},
+		// 没有配置完成的包也是已经安装的
+		{"dde-daemon", "5.12.0.18-1", false},
+		{"dde-dock", "", true},
+		{"dde-control-center", "", true},
+	}
+	for _, tt := range tests {
+		ver, newlyInstalled, err := getOriginalState(tt.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ver != tt.version || newlyInstalled != tt.newlyInstalled {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.pkg, ver, newlyInstalled, tt.version, tt.newlyInstalled)
+		}
+	}
+}
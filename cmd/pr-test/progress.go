@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressBoard 在终端中显示多个下载任务的进度，每个任务占一行。
+type progressBoard struct {
+	mu     sync.Mutex
+	bars   []*progressBar
+	lines  int
+	isTerm bool
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+type progressBar struct {
+	board   *progressBoard
+	name    string
+	current int64
+	total   int64
+	state   string
+}
+
+const (
+	progressStateWaiting = "waiting"
+	progressStateRunning = "running"
+	progressStateDone    = "done"
+	progressStateFailed  = "failed"
+)
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressBoard() *progressBoard {
+	return &progressBoard{
+		isTerm: isTerminal(os.Stdout),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (b *progressBoard) add(name string) *progressBar {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bar := &progressBar{
+		board: b,
+		name:  name,
+		total: -1,
+		state: progressStateWaiting,
+	}
+	b.bars = append(b.bars, bar)
+	return bar
+}
+
+func (b *progressBoard) start() {
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.render()
+			case <-b.quit:
+				b.render()
+				return
+			}
+		}
+	}()
+}
+
+func (b *progressBoard) stop() {
+	close(b.quit)
+	<-b.done
+}
+
+func (b *progressBoard) render() {
+	if !b.isTerm {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var sb strings.Builder
+	if b.lines > 0 {
+		// 光标移动到上次输出的第一行
+		fmt.Fprintf(&sb, "\033[%dA", b.lines)
+	}
+	for _, bar := range b.bars {
+		sb.WriteString("\033[2K")
+		sb.WriteString(bar.line())
+		sb.WriteByte('\n')
+	}
+	b.lines = len(b.bars)
+	fmt.Print(sb.String())
+}
+
+func (bar *progressBar) line() string {
+	name := bar.name
+	if len(name) > 40 {
+		name = name[:37] + "..."
+	}
+	switch bar.state {
+	case progressStateWaiting, progressStateFailed:
+		return fmt.Sprintf("%-40s %s", name, bar.state)
+	}
+
+	const width = 30
+	var percent int64
+	if bar.total > 0 {
+		percent = bar.current * 100 / bar.total
+	}
+	filled := int(percent * width / 100)
+	progress := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+	return fmt.Sprintf("%-40s [%s] %3d%% %s/%s", name, progress, percent,
+		formatSize(bar.current), formatSize(bar.total))
+}
+
+func (bar *progressBar) reset(current, total int64) {
+	bar.board.mu.Lock()
+	bar.current = current
+	bar.total = total
+	bar.state = progressStateRunning
+	bar.board.mu.Unlock()
+}
+
+func (bar *progressBar) finish(err error) {
+	bar.board.mu.Lock()
+	if err != nil {
+		bar.state = progressStateFailed
+	} else {
+		bar.state = progressStateDone
+		if bar.total < 0 {
+			bar.total = bar.current
+		}
+	}
+	bar.board.mu.Unlock()
+
+	if !bar.board.isTerm {
+		if err != nil {
+			fmt.Println("failed to download", bar.name)
+		} else {
+			fmt.Println("downloaded", bar.name)
+		}
+	}
+}
+
+func (bar *progressBar) Write(p []byte) (int, error) {
+	bar.board.mu.Lock()
+	bar.current += int64(len(p))
+	bar.board.mu.Unlock()
+	return len(p), nil
+}
+
+func formatSize(size int64) string {
+	if size < 0 {
+		return "?"
+	}
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sh "github.com/codeskyblue/go-sh"
+)
+
+// 每个测试安装的包在 markDir 中有一个 $pkg.json 文件记录安装信息。
+// 旧版本只创建空的 $pkg 文件，信息都在包的 Description 中，读取时作为后备。
+
+const markDir = "/var/lib/deepin-pr-test"
+
+const recordFileExt = ".json"
+
+type installRecord struct {
+	Package string `json:"package"`
+	// 安装测试包之前的版本，之前没有安装时为空
+	OriginalVersion string `json:"original_version"`
+	NewVersion      string `json:"new_version"`
+	// 之前没有安装，恢复时需要删除
+	NewlyInstalled bool `json:"newly_installed"`
+
+	// 来源，github 或 gerrit
+	Backend     string `json:"backend"`
+	Repo        string `json:"repo"`
+	ChangeNum   int    `json:"change_num"`
+	ChangeUrl   string `json:"change_url"`
+	ChangeTitle string `json:"change_title"`
+	ChangeUser  string `json:"change_user"`
+	ChangeState string `json:"change_state"`
+	// 安装的 revision，gerrit 上是 patch set 的编号，github 上是 head 的 commit id
+	Revision string `json:"revision"`
+
+	CIUrl  string `json:"ci_url"`
+	DebUrl string `json:"deb_url"`
+	// 原来的包保存的 deb 文件
+	BackupDeb string `json:"backup_deb,omitempty"`
+
+	Time        time.Time `json:"time"`
+	InstalledBy string    `json:"installed_by"`
+}
+
+func getCurrentUserName() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// getOriginalState 根据 dpkg 中的状态返回安装测试包之前的版本，以及是否为新安装。
+// dpkg 中没有记录、状态为 not-installed 或 config-files 的包是新安装的，
+// half-configured、unpacked 等状态的包已经安装过，恢复时不能删除。
+func getOriginalState(pkg string) (version string, newlyInstalled bool, err error) {
+	info, err := getPkgDB().getInstalled(pkg)
+	if err != nil {
+		return "", false, err
+	}
+	if info == nil {
+		return "", true, nil
+	}
+	switch info.status {
+	case "not-installed", "config-files":
+		return "", true, nil
+	}
+	return info.version, false, nil
+}
+
+func newInstallRecord(detail *debDetail) (*installRecord, error) {
+	originalVer, newlyInstalled, err := getOriginalState(detail.pkgName)
+	if err != nil {
+		return nil, err
+	}
+	jobDetail := detail.jobDetail
+	return &installRecord{
+		Package:         detail.pkgName,
+		OriginalVersion: originalVer,
+		NewVersion:      detail.newVersion,
+		NewlyInstalled:  newlyInstalled,
+		Backend:         jobDetail.detail.backend,
+		Repo:            jobDetail.detail.repo,
+		ChangeNum:       jobDetail.detail.num,
+		ChangeUrl:       jobDetail.detail.url,
+		ChangeTitle:     jobDetail.detail.title,
+		ChangeUser:      jobDetail.detail.user,
+		ChangeState:     jobDetail.detail.state,
+		Revision:        jobDetail.detail.revision,
+		CIUrl:           jobDetail.url,
+		DebUrl:          detail.url,
+		Time:            time.Now(),
+		InstalledBy:     getCurrentUserName(),
+	}, nil
+}
+
+// newInstallRecordFromDetail 从包的 Description 中的信息构造记录。
+func newInstallRecordFromDetail(pkg string, detail map[string]string) *installRecord {
+	record := &installRecord{
+		Package:     pkg,
+		Backend:     detail["PR_BACKEND"],
+		Repo:        detail["PR_REPO"],
+		ChangeUrl:   detail["PR_URL"],
+		ChangeTitle: detail["PR_TITLE"],
+		ChangeUser:  detail["PR_USER"],
+		ChangeState: detail["PR_STATE"],
+		Revision:    detail["PR_REVISION"],
+		CIUrl:       detail["CI_URL"],
+		DebUrl:      detail["DEB_URL"],
+	}
+	record.ChangeNum, _ = strconv.Atoi(detail["PR_NUM"])
+	record.Time, _ = time.Parse(time.RFC3339, detail["DEB_MODIFY_TIME"])
+	return record
+}
+
+func markInstall(record *installRecord) error {
+	content, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeMarkFile(record.Package+recordFileExt, content)
+}
+
+// writeMarkFile 用 sudo 把 content 写到 markDir 中的 name 文件。
+func writeMarkFile(name string, content []byte) error {
+	_, err := os.Stat(markDir)
+	if os.IsNotExist(err) {
+		err = sh.Command("sudo", "mkdir", "-p", "-m", "0755", markDir).Run()
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile("", "pr-test-record")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := os.Remove(tempFile.Name())
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}()
+	_, err = tempFile.Write(content)
+	if err != nil {
+		_ = tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(markDir, name)
+	err = sh.Command("sudo", "install", "-m", "0644", tempFile.Name(), filename).Run()
+	return err
+}
+
+func markUninstall(pkg string) error {
+	debug("markUninstall", pkg)
+	record, err := readInstallRecord(filepath.Join(markDir, pkg+recordFileExt))
+	if err == nil {
+		err = removeBackupFile(record.BackupDeb)
+		if err != nil {
+			log.Println("WARN: failed to remove backup:", err)
+		}
+	}
+
+	for _, filename := range []string{
+		filepath.Join(markDir, pkg),
+		filepath.Join(markDir, pkg+recordFileExt),
+	} {
+		_, err := os.Stat(filename)
+		if err != nil {
+			debug(err)
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = sh.Command("sudo", "rm", filename).Run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareInstallRecord 构造新的记录并备份原来的包，newBackup 表示 BackupDeb 是这次新建的。
+// 如果包已经是测试安装的，就沿用之前记录的原版本和备份。
+// 无法确定包原来的状态时返回错误，不写入记录。
+func prepareInstallRecord(detail *debDetail) (record *installRecord, newBackup bool, err error) {
+	record, err = newInstallRecord(detail)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get state of %s: %v", detail.pkgName, err)
+	}
+	oldRecord, err := readInstallRecord(filepath.Join(markDir, record.Package+recordFileExt))
+	if err == nil && isTestInstalled(record.Package) {
+		record.OriginalVersion = oldRecord.OriginalVersion
+		record.NewlyInstalled = oldRecord.NewlyInstalled
+		record.BackupDeb = oldRecord.BackupDeb
+		return record, false, nil
+	}
+
+	if record.OriginalVersion != "" {
+		record.BackupDeb, err = backupInstalledDeb(record.Package, record.OriginalVersion)
+		if err != nil {
+			log.Printf("WARN: failed to backup %s: %v\n", record.Package, err)
+			record.BackupDeb = ""
+		}
+	}
+	return record, record.BackupDeb != "", nil
+}
+
+// isTestInstalled 判断已安装的包是否为测试包。
+func isTestInstalled(pkg string) bool {
+	detail, err := getPkgInstallDetail(pkg)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+	return len(detail) > 0
+}
+
+// getTestInstalledCIUrl 返回 pkg 已安装的测试包的 CI_URL，不是测试包时返回空。
+func getTestInstalledCIUrl(pkg string) string {
+	detail, err := getPkgInstallDetail(pkg)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+	return detail["CI_URL"]
+}
+
+func readInstallRecord(filename string) (*installRecord, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var record installRecord
+	err = json.Unmarshal(content, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// loadInstallRecords 读取所有测试安装的包的记录，
+// 如果包已经不是测试安装的版本了，就放到 invalidList 中。
+func loadInstallRecords() (records []*installRecord, invalidList []string, err error) {
+	fileInfos, err := ioutil.ReadDir(markDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	pkgs := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), ".") {
+			continue
+		}
+		pkgs[strings.TrimSuffix(fileInfo.Name(), recordFileExt)] = true
+	}
+
+	for pkg := range pkgs {
+		var detail map[string]string
+		detail, err = getPkgInstallDetail(pkg)
+		if err != nil {
+			log.Println("WARN:", err)
+			err = nil
+		}
+		if len(detail) == 0 {
+			debugF("patchDetail about %s is empty\n", pkg)
+			invalidList = append(invalidList, pkg)
+			continue
+		}
+
+		record, err := readInstallRecord(filepath.Join(markDir, pkg+recordFileExt))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("WARN: failed to read install record:", err)
+			}
+			record = newInstallRecordFromDetail(pkg, detail)
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Time.Equal(records[j].Time) {
+			return records[i].Time.Before(records[j].Time)
+		}
+		return records[i].Package < records[j].Package
+	})
+	sort.Strings(invalidList)
+	return
+}
+
+// getBackend 返回记录的来源，旧的记录中没有，根据 url 判断。
+func (record *installRecord) getBackend() string {
+	if record.Backend != "" {
+		return record.Backend
+	}
+	if strings.HasPrefix(record.ChangeUrl, "https://github.com/") {
+		return "github"
+	}
+	return "gerrit"
+}
+
+// match 判断记录是否符合 -restore 的参数，可以是 all、仓库名、变更编号（NUM 或 REPO#NUM）、
+// 变更或 CI 的 url、用户名，或者包名的通配符。
+func (record *installRecord) match(pattern string) bool {
+	if pattern == "all" {
+		return true
+	}
+	if record.ChangeNum != 0 {
+		num := strconv.Itoa(record.ChangeNum)
+		if pattern == num || pattern == record.Repo+"#"+num {
+			return true
+		}
+	}
+	for _, value := range []string{record.Repo, record.ChangeUser, record.ChangeUrl, record.CIUrl} {
+		if value != "" && strings.TrimSuffix(pattern, "/") == strings.TrimSuffix(value, "/") {
+			return true
+		}
+	}
+	matched, err := path.Match(pattern, record.Package)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+	return matched
+}
+
+// groupRecordsByCIUrl 把同一个 job 安装的包的记录放在一起。
+func groupRecordsByCIUrl(records []*installRecord) [][]*installRecord {
+	var result [][]*installRecord
+	idxMap := make(map[string]int)
+	for _, record := range records {
+		idx, ok := idxMap[record.CIUrl]
+		if !ok {
+			idx = len(result)
+			idxMap[record.CIUrl] = idx
+			result = append(result, nil)
+		}
+		result[idx] = append(result[idx], record)
+	}
+	return result
+}
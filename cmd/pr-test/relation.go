@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/dependency"
+)
+
+// 修改了包的版本后，control 文件的关系字段中引用 job 中的包的 CI 版本也要改成新版本，
+// 否则同一个 job 的包之间会有冲突。
+
+var relationFields = []string{"Pre-Depends", "Depends", "Recommends", "Suggests", "Enhances",
+	"Breaks", "Conflicts", "Replaces", "Provides"}
+
+// versionChange 是 job 中的包的版本变化。
+type versionChange struct {
+	ciVersion        string
+	newVersion       string
+	installedVersion string
+}
+
+type fieldChange struct {
+	name     string
+	oldValue string
+	newValue string
+}
+
+func newVersionChange(pkgKey, ciVer string, policy pkgPolicy, detail *patchDetail) *versionChange {
+	newVer, err := getNewVersion(ciVer, policy, detail)
+	if err != nil {
+		log.Printf("WARN: failed to get new version for %s: %v\n", pkgKey, err)
+	}
+	if newVer == "" {
+		newVer = ciVer
+	}
+	return &versionChange{
+		ciVersion:        ciVer,
+		newVersion:       newVer,
+		installedVersion: policy.installedVersion,
+	}
+}
+
+// getJobVersionChanges 计算 job 中所有包的新版本，没有选择安装的包也计算，
+// 因为选择的包的关系字段可能引用它们。所有包的版本一次查询。
+func getJobVersionChanges(pkgs []*jobPackage, detail *patchDetail) map[string]*versionChange {
+	var keys []string
+	for _, pkg := range pkgs {
+		if pkg.control != nil {
+			keys = append(keys, pkg.key)
+		}
+	}
+	// 查询候选版本失败时，仍然有已安装的版本
+	policies, err := getPkgDB().getPolicies(keys)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+
+	versions := make(map[string]*versionChange)
+	for _, pkg := range pkgs {
+		if pkg.control == nil {
+			continue
+		}
+		versions[pkg.key] = newVersionChange(pkg.key, pkg.control.Values["Version"], policies[pkg.key], detail)
+	}
+	return versions
+}
+
+// findVersionChange 查找关系字段中的包名对应的版本变化，规则同 findSibling。
+func findVersionChange(versions map[string]*versionChange, name, arch string) *versionChange {
+	key, err := getPkgKey(name, arch)
+	if err == nil {
+		if vc, ok := versions[key]; ok {
+			return vc
+		}
+	}
+	return versions[name]
+}
+
+// relationArch 返回关系中的包的架构，指定了 :arch 的用指定的架构，
+// :native 为本机架构，其他（包括 :any）和本包相同。
+func relationArch(possi *dependency.Possibility, arch string) string {
+	if possi.Arch == nil {
+		return arch
+	}
+	switch qualifier := possi.Arch.String(); qualifier {
+	case "any", "":
+		return arch
+	case "native":
+		return ""
+	default:
+		return qualifier
+	}
+}
+
+// rewriteRelationVersions 修改关系字段中的版本，只修改引用 job 中的包且版本为该包 CI 版本的，
+// 改为该包的新版本，其他关系不变，返回修改了的字段。
+func rewriteRelationVersions(para *control.BinaryParagraph, arch string,
+	versions map[string]*versionChange) []fieldChange {
+	var changes []fieldChange
+	for _, field := range relationFields {
+		value := para.Values[field]
+		if value == "" {
+			continue
+		}
+		dep, err := dependency.Parse(value)
+		if err != nil {
+			log.Printf("WARN: failed to parse %s of %s: %v\n", field, para.Package, err)
+			continue
+		}
+
+		var changed bool
+		for _, r := range dep.Relations {
+			for pIdx := range r.Possibilities {
+				possi := &r.Possibilities[pIdx]
+				if possi.Version == nil {
+					continue
+				}
+				vc := findVersionChange(versions, possi.Name, relationArch(possi, arch))
+				if vc == nil || vc.ciVersion == vc.newVersion {
+					continue
+				}
+				if possi.Version.Number == vc.ciVersion {
+					possi.Version.Number = vc.newVersion
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			continue
+		}
+		newValue := dep.String()
+		para.Set(field, newValue)
+		changes = append(changes, fieldChange{
+			name:     field,
+			oldValue: value,
+			newValue: newValue,
+		})
+	}
+	return changes
+}
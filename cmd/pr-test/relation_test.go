@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+)
+
+func parseTestParagraph(t *testing.T, text string) *control.BinaryParagraph {
+	t.Helper()
+	var para control.BinaryParagraph
+	err := control.Unmarshal(&para, strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &para
+}
+
+// dtkVersions 是 dtkcore 的一个 job 中的包的版本变化，libdtkcore5-bin 没有选择安装。
+func dtkVersions() map[string]*versionChange {
+	return map[string]*versionChange{
+		"libdtkcore5":          {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.2-1"},
+		"libdtkcore5:i386":     {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.2-2"},
+		"libdtkcore5-bin":      {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.1-1"},
+		"libdtkcore5-bin:i386": {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.1-2"},
+		"libdtkcore-dev":       {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.2-1"},
+		// 版本没有变化
+		"libdtkgui5": {ciVersion: "5.2.2.3-1", newVersion: "5.2.2.3-1"},
+	}
+}
+
+func ddeVersions() map[string]*versionChange {
+	return map[string]*versionChange{
+		"dde-daemon":        {ciVersion: "5.12.0.18-1", newVersion: "5.12.0.17-1"},
+		"dde-session-shell": {ciVersion: "5.12.0.18-1", newVersion: "5.12.0.16-1"},
+		"dde-daemon-dbgsym": {ciVersion: "5.12.0.18-1", newVersion: "5.12.0.17-1"},
+	}
+}
+
+func TestRewriteRelationVersions(t *testing.T) {
+	_dpkgArchCache = "amd64"
+
+	tests := []struct {
+		name     string
+		para     string
+		versions map[string]*versionChange
+		want     map[string]string
+	}{
+		{
+			name: "exact",
+			para: `Package: libdtkcore-dev
+Version: 5.2.2.3-1
+Architecture: amd64
+Depends: libdtkcore5 (= 5.2.2.3-1), libdtkcore5-bin (= 5.2.2.3-1), libgsettings-qt-dev, qtbase5-dev (>= 5.11.3)
+Suggests: libdtkcore-doc (= 5.2.2.3-1)
+Description: Deepin Tool Kit Core Devel library
+`,
+			versions: dtkVersions(),
+			want: map[string]string{
+				"Depends": "libdtkcore5 (= 5.2.2.2-1), libdtkcore5-bin (= 5.2.2.1-1), libgsettings-qt-dev, qtbase5-dev (>= 5.11.3)",
+			},
+		},
+		{
+			name: "greater or equal",
+			para: `Package: libdtkwidget5
+Version: 5.2.2.3-1
+Architecture: amd64
+Depends: libc6 (>= 2.14), libdtkcore5 (>= 5.2.2.3-1), libdtkgui5 (>= 5.2.2.3-1), libqt5core5a (>= 5.11.0~rc1)
+Description: Deepin tool kit widget modules
+`,
+			versions: dtkVersions(),
+			want: map[string]string{
+				"Depends": "libc6 (>= 2.14), libdtkcore5 (>= 5.2.2.2-1), libdtkgui5 (>= 5.2.2.3-1), libqt5core5a (>= 5.11.0~rc1)",
+			},
+		},
+		{
+			name: "alternatives",
+			para: `Package: dde-daemon
+Version: 5.12.0.18-1
+Architecture: amd64
+Depends: dde-session-shell (= 5.12.0.18-1) | lightdm-deepin-greeter (>= 5.12.0.18-1), deepin-desktop-base (>= 5.12.0.18-1)
+Recommends: dde-daemon-dbgsym (= 5.12.0.18-1) | deepin-manual
+Description: daemon handling the DDE session settings
+`,
+			versions: ddeVersions(),
+			want: map[string]string{
+				"Depends":    "dde-session-shell (= 5.12.0.16-1) | lightdm-deepin-greeter (>= 5.12.0.18-1), deepin-desktop-base (>= 5.12.0.18-1)",
+				"Recommends": "dde-daemon-dbgsym (= 5.12.0.17-1) | deepin-manual",
+			},
+		},
+		{
+			name: "foreign arch",
+			para: `Package: libdtkcore5
+Version: 5.2.2.3-1
+Architecture: i386
+Multi-Arch: same
+Depends: libdtkcore5-bin (= 5.2.2.3-1), libc6 (>= 2.4)
+Description: Deepin tool kit core modules
+`,
+			versions: dtkVersions(),
+			want: map[string]string{
+				"Depends": "libdtkcore5-bin (= 5.2.2.1-2), libc6 (>= 2.4)",
+			},
+		},
+		{
+			name: "arch qualifier",
+			para: `Package: libdtkcore-dev
+Version: 5.2.2.3-1
+Architecture: amd64
+Depends: libdtkcore5:i386 (= 5.2.2.3-1), libdtkcore5-bin:any (= 5.2.2.3-1), libdtkcore5:native (= 5.2.2.3-1)
+Description: Deepin Tool Kit Core Devel library
+`,
+			versions: dtkVersions(),
+			want: map[string]string{
+				"Depends": "libdtkcore5:i386 (= 5.2.2.2-2), libdtkcore5-bin:any (= 5.2.2.1-1), libdtkcore5:native (= 5.2.2.2-1)",
+			},
+		},
+		{
+			name: "provides",
+			para: `Package: libdtkcore5
+Version: 5.2.2.3-1
+Architecture: amd64
+Provides: libdtkcore5-bin (= 5.2.2.3-1), libdtkcore-abi-5 (= 5.2.2.3-1)
+Breaks: libdtkcore-dev (<< 5.2.2.3-1)
+Replaces: libdtkcore-dev (<< 5.2.2.3-1)
+Description: Deepin tool kit core modules
+`,
+			versions: dtkVersions(),
+			want: map[string]string{
+				"Provides": "libdtkcore5-bin (= 5.2.2.1-1), libdtkcore-abi-5 (= 5.2.2.3-1)",
+				"Breaks":   "libdtkcore-dev (<< 5.2.2.2-1)",
+				"Replaces": "libdtkcore-dev (<< 5.2.2.2-1)",
+			},
+		},
+		{
+			name: "not job packages",
+			para: `Package: dde-daemon
+Version: 5.12.0.18-1
+Architecture: amd64
+Depends: deepin-desktop-base (>= 5.12.0.18-1), dde-api (= 5.12.0.18-1)
+Description: daemon handling the DDE session settings
+`,
+			versions: dtkVersions(),
+			want:     map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			para := parseTestParagraph(t, tt.para)
+			old := make(map[string]string)
+			for _, field := range relationFields {
+				old[field] = para.Values[field]
+			}
+
+			changes := rewriteRelationVersions(para, para.Values["Architecture"], tt.versions)
+
+			got := make(map[string]string)
+			for _, c := range changes {
+				if c.oldValue != old[c.name] {
+					t.Errorf("%s old value = %q, want %q", c.name, c.oldValue, old[c.name])
+				}
+				if para.Values[c.name] != c.newValue {
+					t.Errorf("%s = %q, change records %q", c.name, para.Values[c.name], c.newValue)
+				}
+				got[c.name] = c.newValue
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes = %q, want %q", got, tt.want)
+			}
+			for _, field := range relationFields {
+				if _, ok := tt.want[field]; !ok && para.Values[field] != old[field] {
+					t.Errorf("%s changed to %q", field, para.Values[field])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	sh "github.com/codeskyblue/go-sh"
+)
+
+func restore(pattern string) error {
+	err := recoverInstallJournal()
+	if err != nil {
+		return err
+	}
+
+	records, invalidList, err := loadInstallRecords()
+	if err != nil {
+		return err
+	}
+
+	var selected []*installRecord
+	for _, record := range records {
+		if record.match(pattern) {
+			selected = append(selected, record)
+		}
+	}
+	debug("invalidList:", invalidList)
+
+	if len(selected) == 0 && len(invalidList) == 0 {
+		return nil
+	}
+
+	var pkgList []string
+	for _, record := range selected {
+		pkgList = append(pkgList, record.Package)
+	}
+	debug("pkgList:", pkgList)
+
+	if len(selected) > 0 {
+		fmt.Println("restore", pkgList)
+		err = restorePackages(selected)
+		if err != nil {
+			return err
+		}
+	}
+
+	return clearRestoredMarks(append(pkgList, invalidList...))
+}
+
+// clearRestoredMarks 删除已经不是测试版本的包的记录。
+func clearRestoredMarks(pkgList []string) error {
+	for _, pkg := range pkgList {
+		detail, err := getPkgInstallDetail(pkg)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+
+		if len(detail) == 0 {
+			// restore success
+			err = markUninstall(pkg)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Println("WARN: failed to restore", pkg)
+		}
+	}
+	return nil
+}
+
+// restorePackages 优先使用备份的 deb 文件恢复，不需要网络，
+// 没有备份的再用 apt-get 从软件源安装，之前没有安装的包则删除。
+func restorePackages(records []*installRecord) error {
+	var backupDebs []string
+	var aptRecords []*installRecord
+	var removePkgs []string
+	for _, record := range records {
+		if record.NewlyInstalled {
+			removePkgs = append(removePkgs, record.Package)
+			continue
+		}
+		if record.BackupDeb != "" {
+			if _, err := os.Stat(record.BackupDeb); err == nil {
+				backupDebs = append(backupDebs, record.BackupDeb)
+				continue
+			}
+			log.Printf("WARN: backup of %s is missing\n", record.Package)
+		}
+		aptRecords = append(aptRecords, record)
+	}
+
+	if len(backupDebs) > 0 {
+		cmdArgs := append([]string{"dpkg", "-i"}, backupDebs...)
+		err := sh.Command("sudo", cmdArgs).Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(aptRecords) > 0 {
+		cmdArgs := []string{"apt-get", "install", "--fix-missing", "-y", "--reinstall",
+			"--allow-downgrades"}
+		cmdArgs = append(cmdArgs, getRestorePkgArgs(aptRecords)...)
+		err := sh.Command("sudo", cmdArgs).Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(removePkgs) > 0 {
+		fmt.Println("remove newly installed", removePkgs)
+		action := "remove"
+		if flagPurge {
+			action = "purge"
+		}
+		cmdArgs := append([]string{"apt-get", action, "-y"}, removePkgs...)
+		err := sh.Command("sudo", cmdArgs).Run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRestorePkgArgs 返回 apt-get install 的参数，尽量恢复到安装测试包之前的版本。
+func getRestorePkgArgs(records []*installRecord) []string {
+	var args []string
+	for _, record := range records {
+		if record.OriginalVersion == "" {
+			args = append(args, record.Package)
+			continue
+		}
+
+		versions, err := getPkgDB().getAvailableVersions(record.Package)
+		if err != nil {
+			log.Printf("WARN: failed to get available versions of %s: %v\n", record.Package, err)
+		}
+		if strSliceContains(versions, record.OriginalVersion) {
+			args = append(args, record.Package+"="+record.OriginalVersion)
+		} else {
+			log.Printf("WARN: version %s of %s is not available, restore to the candidate version\n",
+				record.OriginalVersion, record.Package)
+			args = append(args, record.Package)
+		}
+	}
+	return args
+}
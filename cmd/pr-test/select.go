@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// 选择要安装的包，-exclude 优先，指定了 -include 时只安装匹配的包，
+// 否则不安装配置文件中 packages.exclude 匹配的包。
+
+var defaultExcludePatterns = []string{"*-dev", "*-dbg", "*-dbgsym", "libdtkwidget-bin"}
+
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// matchPatterns 用包名匹配，外部架构的包也可以用 name:arch 匹配。
+func matchPatterns(patterns []string, pkgName string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, trimPkgArch(pkgName))
+		if err == nil && !matched && pkgName != trimPkgArch(pkgName) {
+			matched, err = path.Match(pattern, pkgName)
+		}
+		if err != nil {
+			log.Printf("WARN: invalid pattern %q: %v\n", pattern, err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func selectPackage(pkgName string) bool {
+	if matchPatterns(splitPatterns(flagExclude), pkgName) {
+		return false
+	}
+	if include := splitPatterns(flagInclude); len(include) > 0 {
+		return matchPatterns(include, pkgName)
+	}
+	return !matchPatterns(getConfig().Packages.Exclude, pkgName)
+}
+
+// askInstallPackage 询问是否安装包，使用 -y 时不询问，直接按规则选择。
+func askInstallPackage(pkgName string) (bool, error) {
+	defaultYes := selectPackage(pkgName)
+	if flagYes {
+		if defaultYes {
+			fmt.Println("install", pkgName)
+		} else {
+			fmt.Println("skip", pkgName)
+		}
+		return defaultYes, nil
+	}
+	return askYesNo(fmt.Sprintf("install %s?", pkgName), defaultYes)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+)
+
+// change 是代码托管平台上的一个改动，比如 github 的 pull request，gerrit 的 change。
+type change struct {
+	detail  *patchDetail
+	jobUrls []string
+}
+
+// changeSource 是代码托管平台的后端，负责把命令行参数解析为 change。
+// 要支持新的平台，实现这个接口，并在 init 中调用 registerChangeSource 即可。
+type changeSource interface {
+	name() string
+	// match 判断参数是否由此后端处理。
+	match(arg string) bool
+	// resolve 把所有由此后端处理的参数一起解析为 change，
+	// 一个参数可能对应多个 change，比如 github 的 issue。
+	resolve(args []string) ([]*change, error)
+	// query 查询安装记录对应的 change 现在的状态。
+	query(record *installRecord) (*changeStatus, error)
+}
+
+const (
+	changeStateOpen   = "open"
+	changeStateMerged = "merged"
+	// github 上关闭但未合并
+	changeStateClosed = "closed"
+	// gerrit 上被放弃
+	changeStateAbandoned = "abandoned"
+)
+
+// changeStatus 是 change 在后端的最新状态。
+type changeStatus struct {
+	state string
+	// 最新的 revision，含义同 patchDetail.revision
+	revision string
+}
+
+var changeSources []changeSource
+
+func registerChangeSource(src changeSource) {
+	changeSources = append(changeSources, src)
+}
+
+func findChangeSource(arg string) (changeSource, error) {
+	for _, src := range changeSources {
+		if src.match(arg) {
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported argument %q", arg)
+}
+
+func getChangeSource(name string) (changeSource, error) {
+	for _, src := range changeSources {
+		if src.name() == name {
+			return src, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown change source %q", name)
+}
+
+type changeStatusResult struct {
+	status *changeStatus
+	err    error
+}
+
+// changeStatusCache 以 ChangeUrl 为键缓存查询结果，查询失败的结果也缓存。
+type changeStatusCache map[string]*changeStatusResult
+
+// queryChangeStatus 查询记录对应的 change 的状态，同一个 change 只查询一次。
+func queryChangeStatus(record *installRecord, cache changeStatusCache) (*changeStatus, error) {
+	if result, ok := cache[record.ChangeUrl]; ok {
+		return result.status, result.err
+	}
+	result := &changeStatusResult{}
+	src, err := getChangeSource(record.getBackend())
+	if err != nil {
+		result.err = err
+	} else {
+		result.status, result.err = src.query(record)
+	}
+	cache[record.ChangeUrl] = result
+	return result.status, result.err
+}
+
+func resolveChanges(args []string) ([]*change, error) {
+	var sources []changeSource
+	srcArgsMap := make(map[changeSource][]string)
+	for _, arg := range args {
+		src, err := findChangeSource(arg)
+		if err != nil {
+			return nil, err
+		}
+		debugF("arg %q is handled by %s\n", arg, src.name())
+		if _, ok := srcArgsMap[src]; !ok {
+			sources = append(sources, src)
+		}
+		srcArgsMap[src] = append(srcArgsMap[src], arg)
+	}
+
+	var result []*change
+	for _, src := range sources {
+		changes, err := src.resolve(srcArgsMap[src])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, changes...)
+	}
+	return result, nil
+}
+
+func installChange(c *change) error {
+	for _, jobUrl := range c.jobUrls {
+		err := installJobDebs(jobUrl, c.detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
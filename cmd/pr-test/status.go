@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	statusFormatText  = "text"
+	statusFormatTable = "table"
+	statusFormatJson  = "json"
+)
+
+// statusItem 是 -status 输出的一个测试安装的包。
+type statusItem struct {
+	Package         string `json:"package"`
+	OriginalVersion string `json:"original_version"`
+	CurrentVersion  string `json:"current_version"`
+	NewlyInstalled  bool   `json:"newly_installed"`
+
+	Backend     string `json:"backend"`
+	Repo        string `json:"repo"`
+	ChangeNum   int    `json:"change_num"`
+	ChangeUrl   string `json:"change_url"`
+	ChangeTitle string `json:"change_title"`
+	ChangeUser  string `json:"change_user"`
+	// 从后端查询到的状态，查询失败时为空，错误信息在 StateError 中
+	ChangeState string `json:"change_state"`
+	StateError  string `json:"state_error,omitempty"`
+
+	CIUrl       string    `json:"ci_url"`
+	InstallTime time.Time `json:"install_time"`
+	InstalledBy string    `json:"installed_by"`
+}
+
+func getStatusFormat() (string, error) {
+	if flagJson {
+		return statusFormatJson, nil
+	}
+	switch flagFormat {
+	case "":
+		return statusFormatText, nil
+	case statusFormatText, statusFormatTable, statusFormatJson:
+		return flagFormat, nil
+	}
+	return "", fmt.Errorf("invalid format %q", flagFormat)
+}
+
+func newStatusItem(record *installRecord, statusCache changeStatusCache) *statusItem {
+	item := &statusItem{
+		Package:         record.Package,
+		OriginalVersion: record.OriginalVersion,
+		NewlyInstalled:  record.NewlyInstalled,
+		Backend:         record.getBackend(),
+		Repo:            record.Repo,
+		ChangeNum:       record.ChangeNum,
+		ChangeUrl:       record.ChangeUrl,
+		ChangeTitle:     record.ChangeTitle,
+		ChangeUser:      record.ChangeUser,
+		CIUrl:           record.CIUrl,
+		InstallTime:     record.Time,
+		InstalledBy:     record.InstalledBy,
+	}
+
+	ver, err := getPkgDB().getInstalledVersion(record.Package)
+	if err != nil {
+		debug("failed to get installed version:", err)
+	}
+	item.CurrentVersion = ver
+
+	status, err := queryChangeStatus(record, statusCache)
+	if err != nil {
+		item.StateError = err.Error()
+	} else {
+		item.ChangeState = status.state
+	}
+	return item
+}
+
+func showStatus() error {
+	format, err := getStatusFormat()
+	if err != nil {
+		return err
+	}
+	records, _, err := loadInstallRecords()
+	if err != nil {
+		return err
+	}
+
+	statusCache := make(changeStatusCache)
+	items := make([]*statusItem, 0, len(records))
+	itemMap := make(map[*installRecord]*statusItem, len(records))
+	for _, record := range records {
+		item := newStatusItem(record, statusCache)
+		items = append(items, item)
+		itemMap[record] = item
+	}
+
+	switch format {
+	case statusFormatJson:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	case statusFormatTable:
+		return showStatusTable(items)
+	}
+	var groups [][]*statusItem
+	for _, recordGroup := range groupRecordsByCIUrl(records) {
+		var group []*statusItem
+		for _, record := range recordGroup {
+			group = append(group, itemMap[record])
+		}
+		groups = append(groups, group)
+	}
+	showStatusText(groups)
+	return nil
+}
+
+func (item *statusItem) getStateText() string {
+	if item.StateError != "" {
+		return "unknown"
+	}
+	return item.ChangeState
+}
+
+func (item *statusItem) getOriginalText() string {
+	if item.NewlyInstalled {
+		return "(none)"
+	}
+	return item.OriginalVersion
+}
+
+func showStatusTable(items []*statusItem) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tORIGINAL\tCURRENT\tREPO\tCHANGE\tSTATE\tINSTALLED")
+	for _, item := range items {
+		var installTime string
+		if !item.InstallTime.IsZero() {
+			installTime = item.InstallTime.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.Package,
+			item.getOriginalText(), item.CurrentVersion, item.Repo, item.ChangeUrl, item.getStateText(), installTime)
+	}
+	return w.Flush()
+}
+
+// showStatusText 同一个 job 安装的包一起显示。
+func showStatusText(groups [][]*statusItem) {
+	for _, group := range groups {
+		item := group[0]
+		var pkgs []string
+		for _, i := range group {
+			pkgs = append(pkgs, fmt.Sprintf("%s (%s -> %s)", i.Package, i.getOriginalText(), i.CurrentVersion))
+		}
+		if item.Repo != "" {
+			fmt.Println("Repo:", item.Repo)
+		}
+		fmt.Println("Package:", strings.Join(pkgs, " "))
+		fmt.Println("Title:", item.ChangeTitle)
+		fmt.Println("User:", item.ChangeUser)
+		fmt.Println("PR url:", item.ChangeUrl)
+		fmt.Println("State:", item.getStateText())
+		fmt.Println("Job url:", item.CIUrl)
+		if !item.InstallTime.IsZero() {
+			fmt.Println("Installed:", item.InstallTime.Format(time.RFC3339), "by", item.InstalledBy)
+		}
+		fmt.Println()
+	}
+}
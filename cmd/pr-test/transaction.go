@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	sh "github.com/codeskyblue/go-sh"
+)
+
+// 安装测试包时先在 markDir 中写入日志，记录计划安装的包和安装前的状态，
+// apt 失败或者被中断时按日志回滚，安装成功并确认装上了这次的测试包后才写入记录。
+// 测试包的版本可能和已安装的版本相同（见 versionPolicyInstalled），
+// 所以通过 Description 中的 CI_URL 判断装上的是不是这次的测试包。
+// 如果进程被杀死，下次运行时根据留下的日志回滚。
+
+const journalFilename = ".journal.json"
+
+const (
+	journalStateInstalling = "installing"
+	journalStateRollback   = "rollback"
+)
+
+type installJournal struct {
+	CIUrl   string          `json:"ci_url"`
+	Time    time.Time       `json:"time"`
+	State   string          `json:"state"`
+	Entries []*journalEntry `json:"entries"`
+}
+
+type journalEntry struct {
+	Record *installRecord `json:"record"`
+	// 安装前实际安装的版本，如果之前已经安装了测试包，和 Record.OriginalVersion 不同
+	PreviousVersion string `json:"previous_version"`
+	// 安装前已安装的测试包的 CI_URL，不是测试包时为空
+	PreviousCIUrl string `json:"previous_ci_url"`
+	// apt 执行后实际安装的版本
+	ActualVersion string `json:"actual_version"`
+	// apt 执行后已安装的测试包的 CI_URL
+	ActualCIUrl string `json:"actual_ci_url"`
+	// Record.BackupDeb 是这次安装前新建的，没有写入记录时要删除
+	NewBackup bool `json:"new_backup"`
+}
+
+// installedByJob 返回 apt 执行后是否装上了 ciUrl 的测试包。
+func (entry *journalEntry) installedByJob(ciUrl string) bool {
+	return entry.ActualCIUrl == ciUrl
+}
+
+// removeNewBackup 删除没有写入记录的包新建的备份，沿用旧记录的备份不删除。
+func (entry *journalEntry) removeNewBackup() {
+	if !entry.NewBackup || entry.Record.BackupDeb == "" {
+		return
+	}
+	err := removeBackupFile(entry.Record.BackupDeb)
+	if err != nil {
+		log.Println("WARN: failed to remove backup:", err)
+	}
+}
+
+func (j *installJournal) save() error {
+	content, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeMarkFile(journalFilename, content)
+}
+
+func removeInstallJournal() error {
+	filename := filepath.Join(markDir, journalFilename)
+	_, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return sh.Command("sudo", "rm", filename).Run()
+}
+
+func readInstallJournal() (*installJournal, error) {
+	content, err := ioutil.ReadFile(filepath.Join(markDir, journalFilename))
+	if err != nil {
+		return nil, err
+	}
+	var j installJournal
+	err = json.Unmarshal(content, &j)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (j *installJournal) updateActualState() {
+	for _, entry := range j.Entries {
+		pkg := entry.Record.Package
+		ver, err := getPkgDB().getInstalledVersion(pkg)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+		entry.ActualVersion = ver
+		entry.ActualCIUrl = getTestInstalledCIUrl(pkg)
+	}
+}
+
+// rollback 把装上了这次的测试包、之前不是测试包的包恢复到安装前的状态。
+// 之前装的是其他 job 的测试包的，保留其原来的记录，之后仍然可以用 -restore 恢复。
+func (j *installJournal) rollback() error {
+	j.State = journalStateRollback
+	err := j.save()
+	if err != nil {
+		log.Println("WARN: failed to save journal:", err)
+	}
+
+	// apt 被中断时 dpkg 可能处于未完成的状态
+	err = sh.Command("sudo", "dpkg", "--configure", "-a").Run()
+	if err != nil {
+		log.Println("WARN: dpkg --configure -a failed:", err)
+	}
+	j.updateActualState()
+
+	var records []*installRecord
+	var pkgList []string
+	for _, entry := range j.Entries {
+		if !entry.installedByJob(j.CIUrl) || entry.PreviousCIUrl == j.CIUrl {
+			continue
+		}
+		if entry.PreviousCIUrl != "" {
+			log.Printf("WARN: %s was test installed by %s, keep its record\n",
+				entry.Record.Package, entry.PreviousCIUrl)
+			continue
+		}
+		records = append(records, entry.Record)
+		pkgList = append(pkgList, entry.Record.Package)
+	}
+	if len(records) > 0 {
+		fmt.Println("rollback", pkgList)
+		err = restorePackages(records)
+		if err != nil {
+			return fmt.Errorf("rollback failed: %v, please run pr-test -restore all", err)
+		}
+		err = clearRestoredMarks(pkgList)
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range j.Entries {
+		entry.removeNewBackup()
+	}
+	return removeInstallJournal()
+}
+
+// recoverInstallJournal 处理上次没有正常结束的安装留下的日志。
+func recoverInstallJournal() error {
+	j, err := readInstallJournal()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Println("WARN: invalid install journal:", err)
+		return removeInstallJournal()
+	}
+	fmt.Printf("found unfinished install of %s at %s, rollback\n", j.CIUrl,
+		j.Time.Format(time.RFC3339))
+	return j.rollback()
+}
+
+// installDebsTransaction 安装 files，失败或者被中断时回滚，
+// 成功后只为确认已经装上了这次的测试包的包写入记录。
+func installDebsTransaction(jobUrl string, debDetails []*debDetail, files []string,
+	aptArgs []string) error {
+	j := &installJournal{
+		CIUrl: jobUrl,
+		Time:  time.Now(),
+		State: journalStateInstalling,
+	}
+	for _, debDetail := range debDetails {
+		record, newBackup, err := prepareInstallRecord(debDetail)
+		if err != nil {
+			for _, entry := range j.Entries {
+				entry.removeNewBackup()
+			}
+			return err
+		}
+		j.Entries = append(j.Entries, &journalEntry{
+			Record:          record,
+			PreviousVersion: debDetail.installedVersion,
+			PreviousCIUrl:   getTestInstalledCIUrl(record.Package),
+			NewBackup:       newBackup,
+		})
+	}
+	err := j.save()
+	if err != nil {
+		for _, entry := range j.Entries {
+			entry.removeNewBackup()
+		}
+		return err
+	}
+
+	// Ctrl-C 也会发给 apt，等 apt 退出后再回滚
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	cmdArgs := append(aptArgs, files...)
+	err = sh.Command("sudo", cmdArgs).Run()
+	select {
+	case sig := <-sigCh:
+		if err == nil {
+			err = fmt.Errorf("interrupted by %v", sig)
+		}
+	default:
+	}
+	if err != nil {
+		log.Println("WARN: install failed:", err)
+		rollbackErr := j.rollback()
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	j.updateActualState()
+	var failedPkgs []string
+	for _, entry := range j.Entries {
+		if !entry.installedByJob(jobUrl) {
+			failedPkgs = append(failedPkgs, entry.Record.Package)
+			entry.removeNewBackup()
+			continue
+		}
+		err = markInstall(entry.Record)
+		if err != nil {
+			return err
+		}
+	}
+	err = removeInstallJournal()
+	if err != nil {
+		return err
+	}
+	if len(failedPkgs) > 0 {
+		return errors.New("test package is not installed: " + strings.Join(failedPkgs, " "))
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"pault.ag/go/debian/version"
+)
+
+// 测试包的版本策略：
+// ci 保持 CI 构建的版本；
+// installed 使用已安装的版本，没有安装时使用软件源中的版本；
+// above 在已安装的版本后加上 +prtest<change>.<revision>，比已安装的版本和候选版本稍高，
+// 软件源中有了更新的版本时 apt 会提示升级。
+
+const (
+	versionPolicyCI        = "ci"
+	versionPolicyInstalled = "installed"
+	versionPolicyAbove     = "above"
+)
+
+const defaultVersionPolicy = versionPolicyInstalled
+
+const prTestVersionTag = "+prtest"
+
+// 再次安装测试包时，已安装的版本可能已经有了后缀
+var regPrTestVersionSuffix = regexp.MustCompile(`\+prtest[^+]*$`)
+
+// getNewVersion 根据包的已安装版本和候选版本返回测试包要使用的版本。
+func getNewVersion(ciVer string, pkgPolicy pkgPolicy, detail *patchDetail) (newVer string, err error) {
+	installedVer, candidateVer := pkgPolicy.installedVersion, pkgPolicy.candidateVersion
+	baseVer := installedVer
+	if baseVer == "" {
+		baseVer = candidateVer
+	}
+
+	switch policy := getConfig().Version.Policy; policy {
+	case versionPolicyCI:
+		newVer = ciVer
+	case versionPolicyInstalled:
+		newVer = baseVer
+	case versionPolicyAbove:
+		if baseVer == "" {
+			newVer = ciVer
+			break
+		}
+		newVer, err = getAboveVersion(installedVer, candidateVer, detail)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("invalid version policy %q", policy)
+	}
+	return newVer, nil
+}
+
+// 再次安装同一个 revision 时，新版本和已安装的相同，在后缀后加上序号，最多尝试这么多次
+const maxAboveVersionSeq = 100
+
+// getAboveVersion 返回比已安装的版本和候选版本都高的版本，比如 5.0.1-1+prtest36.1a2b3c4d。
+// 以两者中较高的为基础，去掉之前测试安装加的后缀后加上新的后缀，还不够高时在后缀后加上序号。
+func getAboveVersion(installedVer, candidateVer string, detail *patchDetail) (string, error) {
+	var floors []version.Version
+	for _, v := range []string{installedVer, candidateVer} {
+		if v == "" {
+			continue
+		}
+		ver, err := version.Parse(v)
+		if err != nil {
+			return "", err
+		}
+		floors = append(floors, ver)
+	}
+	if len(floors) == 0 {
+		return "", errors.New("no installed or candidate version")
+	}
+	base := floors[0]
+	for _, ver := range floors[1:] {
+		if version.Compare(ver, base) > 0 {
+			base = ver
+		}
+	}
+	// 去掉之前测试安装加的后缀，后缀都在 revision 中，没有 revision 时在 version 中
+	if base.Revision != "" {
+		base.Revision = regPrTestVersionSuffix.ReplaceAllString(base.Revision, "")
+	} else {
+		base.Version = regPrTestVersionSuffix.ReplaceAllString(base.Version, "")
+	}
+
+	suffix := prTestVersionTag + strconv.Itoa(detail.num) + "." + shortRevision(detail.revision)
+	for seq := 0; seq <= maxAboveVersionSeq; seq++ {
+		s := suffix
+		if seq > 0 {
+			s += "." + strconv.Itoa(seq)
+		}
+		newVer := base
+		if newVer.Revision != "" {
+			newVer.Revision += s
+		} else {
+			newVer.Version += s
+		}
+		if isAboveVersions(newVer, floors) {
+			return newVer.String(), nil
+		}
+	}
+	return "", fmt.Errorf("can not find a version above %s with suffix %s", base, suffix)
+}
+
+func isAboveVersions(ver version.Version, others []version.Version) bool {
+	for _, other := range others {
+		if version.Compare(ver, other) <= 0 {
+			return false
+		}
+	}
+	return true
+}
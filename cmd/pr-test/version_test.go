@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGetAboveVersion(t *testing.T) {
+	detail := &patchDetail{num: 36, revision: "1a2b3c4d5e6f7a8b"}
+	tests := []struct {
+		installed string
+		candidate string
+		want      string
+	}{
+		{"5.0.1-1", "", "5.0.1-1+prtest36.1a2b3c4d"},
+		{"", "5.0.1-1", "5.0.1-1+prtest36.1a2b3c4d"},
+		{"5.0.1", "5.0.1", "5.0.1+prtest36.1a2b3c4d"},
+		// 软件源中有更高的版本
+		{"5.0.1-1", "5.0.2-1", "5.0.2-1+prtest36.1a2b3c4d"},
+		// 替换之前测试安装加的后缀
+		{"5.0.1-1+prtest30.abcdef12", "5.0.1-1", "5.0.1-1+prtest36.1a2b3c4d"},
+		// 再次安装同一个 revision
+		{"5.0.1-1+prtest36.1a2b3c4d", "5.0.1-1", "5.0.1-1+prtest36.1a2b3c4d.1"},
+		{"5.0.1-1+prtest36.1a2b3c4d.1", "5.0.1-1", "5.0.1-1+prtest36.1a2b3c4d.2"},
+		{"1:5.0.1-1", "", "1:5.0.1-1+prtest36.1a2b3c4d"},
+	}
+	for _, tt := range tests {
+		got, err := getAboveVersion(tt.installed, tt.candidate, detail)
+		if err != nil {
+			t.Errorf("%q, %q: %v", tt.installed, tt.candidate, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q, %q: got %s, want %s", tt.installed, tt.candidate, got, tt.want)
+		}
+	}
+
+	// 已安装的测试版本的后缀更高，加上序号也不够高
+	_, err := getAboveVersion("5.0.1-1+prtest36.ffffffff", "5.0.1-1", detail)
+	if err == nil {
+		t.Error("expect error")
+	}
+	_, err = getAboveVersion("", "", detail)
+	if err == nil {
+		t.Error("expect error")
+	}
+}
@@ -6,7 +6,10 @@ require (
 	github.com/andygrunwald/go-gerrit v0.0.0-20200503132804-ed2419acda39
 	github.com/codeskyblue/go-sh v0.0.0-20200712050446-30169cf553fe
 	github.com/google/go-github v17.0.0+incompatible
+	github.com/klauspost/compress v1.11.13
 	github.com/levigross/grequests v0.0.0-20190908174114-253788527a1a
+	github.com/pierrec/lz4/v4 v4.1.17
+	github.com/ulikunitz/xz v0.5.10
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/yaml.v2 v2.3.0
 	pault.ag/go/debian v0.0.0-20190530135403-b831f604d664